@@ -0,0 +1,44 @@
+package graphite
+
+// Batch collects metrics to send together, with the ergonomics of SimpleSend,
+// see NewBatch. A Batch is not safe for concurrent use.
+type Batch struct {
+	graphite *Graphite
+	metrics  []Metric
+}
+
+// NewBatch returns an empty Batch that sends to graphite
+func (graphite *Graphite) NewBatch() *Batch {
+	return &Batch{graphite: graphite}
+}
+
+// Add adds a metric with a string value to the batch
+func (batch *Batch) Add(name string, value string) {
+	batch.metrics = append(batch.metrics, NewMetric(name, value, 0))
+}
+
+// AddFloat adds a metric with a float value to the batch, formatted like
+// NewMetricFloat does
+func (batch *Batch) AddFloat(name string, value float64) {
+	batch.metrics = append(batch.metrics, NewMetricFloat(name, value, 0))
+}
+
+// Len returns the number of metrics in the batch
+func (batch *Batch) Len() int {
+	return len(batch.metrics)
+}
+
+// Send sends the metrics in the batch in one go, all with the current time as
+// timestamp, and empties the batch so that it can be reused
+func (batch *Batch) Send() error {
+	if len(batch.metrics) == 0 {
+		return nil
+	}
+	timestamp := batch.graphite.timestampNow().Unix()
+	for i := range batch.metrics {
+		batch.metrics[i].Timestamp = timestamp
+	}
+	err := batch.graphite.SendMetrics(batch.metrics)
+	batch.metrics = batch.metrics[:0]
+	return err
+}
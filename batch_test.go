@@ -0,0 +1,37 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	clock := newFakeClock()
+	clock.step = time.Second
+	gr.clock = clock
+
+	batch := gr.NewBatch()
+	batch.Add("requests", "10")
+	batch.AddFloat("latency", 0.25)
+	batch.Add("errors", "1")
+	if batch.Len() != 3 {
+		t.Errorf("Batch has %d metrics", batch.Len())
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Wrote %q before Send", buf.String())
+	}
+
+	if err := batch.Send(); err != nil {
+		t.Error(err)
+	}
+	expected := "app.requests 10 1500000000\napp.latency 0.25 1500000000\napp.errors 1 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if batch.Len() != 0 || gr.Stats().Flushes != 1 {
+		t.Errorf("Batch has %d metrics after Send, %d flushes", batch.Len(), gr.Stats().Flushes)
+	}
+}
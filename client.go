@@ -0,0 +1,16 @@
+package graphite
+
+// Client is the interface of a Graphite client, implemented by *Graphite, so
+// that code sending metrics can accept it and be tested with a fake such as
+// the ones in the graphitetest package
+type Client interface {
+	Connect() error
+	Disconnect() error
+	Flush() error
+	Close() error
+	SendMetric(metric Metric) error
+	SendMetrics(metrics []Metric) error
+	SimpleSend(stat string, value string) error
+}
+
+var _ Client = (*Graphite)(nil)
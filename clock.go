@@ -0,0 +1,97 @@
+package graphite
+
+import (
+	"time"
+)
+
+// clock is the source of time of a Graphite client, tests replace it to
+// control time
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// ticker is the subset of time.Ticker used by the client
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock used by default
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// realTicker adapts time.Ticker to the ticker interface
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// now returns the current time according to the client clock
+func (graphite *Graphite) now() time.Time {
+	if graphite.clock == nil {
+		return realClock{}.Now()
+	}
+	return graphite.clock.Now()
+}
+
+// timestampNow returns the current time corrected by TimestampOffset, for the
+// timestamps picked by the client
+func (graphite *Graphite) timestampNow() time.Time {
+	return graphite.clientTime(graphite.now())
+}
+
+// clientTime corrects t, picked by the client, by TimestampOffset. With
+// TimestampOffsetAll the correction is left to offsetTimestamp, which applies
+// it to all the metrics alike, so that it isn't applied twice.
+func (graphite *Graphite) clientTime(t time.Time) time.Time {
+	if graphite.TimestampOffsetAll {
+		return t
+	}
+	return t.Add(graphite.TimestampOffset)
+}
+
+// offsetTimestamp corrects timestamp by TimestampOffset when
+// TimestampOffsetAll is set
+func (graphite *Graphite) offsetTimestamp(timestamp int64) int64 {
+	if !graphite.TimestampOffsetAll {
+		return timestamp
+	}
+	return time.Unix(timestamp, 0).Add(graphite.TimestampOffset).Unix()
+}
+
+// newTicker returns a ticker firing every d according to the client clock
+func (graphite *Graphite) newTicker(d time.Duration) ticker {
+	if graphite.clock == nil {
+		return realClock{}.NewTicker(d)
+	}
+	return graphite.clock.NewTicker(d)
+}
+
+// after returns a channel receiving the time once d has elapsed according to
+// the client clock
+func (graphite *Graphite) after(d time.Duration) <-chan time.Time {
+	if graphite.clock == nil {
+		return realClock{}.After(d)
+	}
+	return graphite.clock.After(d)
+}
@@ -0,0 +1,107 @@
+package graphite
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to: Advance moves it forward
+// and step, when set, advances it at every call to Now. Advance fires the
+// tickers that are due, blocking until each tick is received, and the timers
+// returned by After, which don't block.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	step    time.Duration
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	now := clock.now
+	clock.now = clock.now.Add(clock.step)
+	return now
+}
+
+func (clock *fakeClock) NewTicker(d time.Duration) ticker {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	t := &fakeTicker{clock: clock, c: make(chan time.Time), period: d, next: clock.now.Add(d)}
+	clock.tickers = append(clock.tickers, t)
+	return t
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	t := &fakeTicker{clock: clock, c: make(chan time.Time, 1), period: d, next: clock.now.Add(d), once: true}
+	clock.tickers = append(clock.tickers, t)
+	return t.c
+}
+
+// timers returns the number of tickers and timers that haven't stopped
+func (clock *fakeClock) timers() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	n := 0
+	for _, t := range clock.tickers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	type tick struct {
+		c    chan time.Time
+		time time.Time
+	}
+	var ticks []tick
+
+	clock.mu.Lock()
+	clock.now = clock.now.Add(d)
+	for _, t := range clock.tickers {
+		for !t.stopped && !t.next.After(clock.now) {
+			ticks = append(ticks, tick{t.c, t.next})
+			t.next = t.next.Add(t.period)
+			t.stopped = t.once
+		}
+	}
+	clock.mu.Unlock()
+
+	for _, tick := range ticks {
+		tick.c <- tick.time
+	}
+}
+
+// fakeTicker is a ticker driven by fakeClock.Advance, or a timer when once is
+// set
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+	once    bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.stopped = true
+}
@@ -0,0 +1,40 @@
+package graphite
+
+// coalescedBatch collects the metrics of concurrent SendMetric calls during a
+// CoalesceWindow
+type coalescedBatch struct {
+	metrics []Metric
+	done    chan struct{}
+	err     error
+}
+
+// sendCoalesced adds metric to the pending batch, or starts one, and waits for
+// the batch to be sent. The caller starting a batch sends it once the window
+// elapses.
+func (graphite *Graphite) sendCoalesced(metric Metric) error {
+	graphite.coalesceMu.Lock()
+	batch := graphite.pending
+	leader := batch == nil
+	if leader {
+		batch = &coalescedBatch{done: make(chan struct{})}
+		graphite.pending = batch
+	}
+	batch.metrics = append(batch.metrics, metric)
+	graphite.coalesceMu.Unlock()
+
+	if !leader {
+		<-batch.done
+		return batch.err
+	}
+
+	<-graphite.after(graphite.CoalesceWindow)
+	graphite.coalesceMu.Lock()
+	graphite.pending = nil
+	graphite.coalesceMu.Unlock()
+
+	graphite.mu.Lock()
+	batch.err = graphite.sendMetrics(batch.metrics)
+	graphite.mu.Unlock()
+	close(batch.done)
+	return batch.err
+}
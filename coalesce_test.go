@@ -0,0 +1,78 @@
+package graphite
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalesceWindow(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.CoalesceWindow = 10 * time.Millisecond
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := gr.SendMetric(NewMetric("foo", 1, 1500000000)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 50 {
+		t.Errorf("Wrote %d lines, expected 50", lines)
+	}
+	if flushes := gr.Stats().Flushes; flushes > 10 {
+		t.Errorf("50 concurrent sends took %d flushes", flushes)
+	}
+}
+
+func TestCoalesceWindowClock(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	clock := newFakeClock()
+	gr.clock = clock
+	gr.CoalesceWindow = time.Second
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := gr.SendMetric(NewMetric("foo", 1, 1500000000)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// wait for all the sends to join the batch started by the first one
+	for {
+		gr.coalesceMu.Lock()
+		joined := gr.pending != nil && len(gr.pending.metrics) == 50
+		gr.coalesceMu.Unlock()
+		if joined && clock.timers() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Wrote %q before the window elapsed", buf.String())
+	}
+
+	clock.Advance(time.Second)
+	wg.Wait()
+	if lines := strings.Count(buf.String(), "\n"); lines != 50 {
+		t.Errorf("Wrote %d lines, expected 50", lines)
+	}
+	if flushes := gr.Stats().Flushes; flushes != 1 {
+		t.Errorf("50 coalesced sends took %d flushes, expected 1", flushes)
+	}
+}
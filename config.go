@@ -0,0 +1,304 @@
+package graphite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultPort is the port carbon listens on for the plaintext protocol
+const defaultPort = 2003
+
+// Config is a struct that captures the settings of a Graphite connection, so
+// that they can be built declaratively and passed around. The zero value of
+// every field selects the default behaviour.
+//
+// Config can be unmarshalled from JSON and YAML, durations are written as
+// strings such as "3s".
+type Config struct {
+	Host string `json:"host" yaml:"host"`
+	// Port defaults to 2003
+	Port int `json:"port" yaml:"port"`
+	// Protocol is one of "tcp", "udp" or "nop" and defaults to "tcp"
+	Protocol string `json:"protocol" yaml:"protocol"`
+	// Timeout defaults to 5 seconds
+	Timeout               time.Duration `json:"timeout" yaml:"timeout"`
+	Prefix                string        `json:"prefix" yaml:"prefix"`
+	DisableLog            bool          `json:"disable_log" yaml:"disable_log"`
+	ConnectRetries        int           `json:"connect_retries" yaml:"connect_retries"`
+	ConnectRetryDelay     time.Duration `json:"connect_retry_delay" yaml:"connect_retry_delay"`
+	CheckConnBeforeSend   bool          `json:"check_conn_before_send" yaml:"check_conn_before_send"`
+	SendInterval          bool          `json:"send_interval" yaml:"send_interval"`
+	NoDelay               bool          `json:"no_delay" yaml:"no_delay"`
+	BufferSize            int           `json:"buffer_size" yaml:"buffer_size"`
+	ManualFlush           bool          `json:"manual_flush" yaml:"manual_flush"`
+	MinFlushInterval      time.Duration `json:"min_flush_interval" yaml:"min_flush_interval"`
+	AutoFlushInterval     time.Duration `json:"auto_flush_interval" yaml:"auto_flush_interval"`
+	MaxConnectionAge      time.Duration `json:"max_connection_age" yaml:"max_connection_age"`
+	OpTimeout             time.Duration `json:"op_timeout" yaml:"op_timeout"`
+	TimestampOffset       time.Duration `json:"timestamp_offset" yaml:"timestamp_offset"`
+	TimestampOffsetAll    bool          `json:"timestamp_offset_all" yaml:"timestamp_offset_all"`
+	MaxLineLength         int           `json:"max_line_length" yaml:"max_line_length"`
+	MaxNameSegments       int           `json:"max_name_segments" yaml:"max_name_segments"`
+	Debug                 bool          `json:"debug" yaml:"debug"`
+	MaxDatagramSize       int           `json:"max_datagram_size" yaml:"max_datagram_size"`
+	MaxMetricsPerDatagram int           `json:"max_metrics_per_datagram" yaml:"max_metrics_per_datagram"`
+	UDPSendBuffer         int           `json:"udp_send_buffer" yaml:"udp_send_buffer"`
+	UDPReceiveBuffer      int           `json:"udp_receive_buffer" yaml:"udp_receive_buffer"`
+	AutoReconnect         bool          `json:"auto_reconnect" yaml:"auto_reconnect"`
+	TCPFallback           bool          `json:"tcp_fallback" yaml:"tcp_fallback"`
+
+	// the metric and reporting options, see the fields of Graphite
+	UseBatchTimestamp       bool              `json:"use_batch_timestamp" yaml:"use_batch_timestamp"`
+	CoalesceWindow          time.Duration     `json:"coalesce_window" yaml:"coalesce_window"`
+	FlushBytesThreshold     int               `json:"flush_bytes_threshold" yaml:"flush_bytes_threshold"`
+	ReportFlushCount        bool              `json:"report_flush_count" yaml:"report_flush_count"`
+	ReportDropped           bool              `json:"report_dropped" yaml:"report_dropped"`
+	RetainRecent            int               `json:"retain_recent" yaml:"retain_recent"`
+	NopLogSampleRate        float64           `json:"nop_log_sample_rate" yaml:"nop_log_sample_rate"`
+	ValidateMetrics         bool              `json:"validate_metrics" yaml:"validate_metrics"`
+	ClampNegativeTimestamps bool              `json:"clamp_negative_timestamps" yaml:"clamp_negative_timestamps"`
+	UnitSuffix              bool              `json:"unit_suffix" yaml:"unit_suffix"`
+	FailOnMalformed         bool              `json:"fail_on_malformed" yaml:"fail_on_malformed"`
+	DefaultTags             map[string]string `json:"default_tags,omitempty" yaml:"default_tags,omitempty"`
+
+	// Linger, when set, is the SO_LINGER timeout in seconds, see
+	// Graphite.Linger
+	Linger *int `json:"linger,omitempty" yaml:"linger,omitempty"`
+	// FallbackToNop makes NewGraphiteFromConfig return a nop client, after
+	// logging the error, instead of failing when it can't connect
+	FallbackToNop bool `json:"fallback_to_nop" yaml:"fallback_to_nop"`
+	// FallbackRetryInterval, when set with FallbackToNop, makes the client
+	// keep trying to connect in the background and switch back to live
+	// mode when it succeeds; Close stops the retries
+	FallbackRetryInterval time.Duration `json:"fallback_retry_interval" yaml:"fallback_retry_interval"`
+	// Logger and OnStateChange can't be unmarshalled and must be set in code,
+	// like the other hooks of Graphite, such as Rename or Tee, and the
+	// policies with no text form, such as TagStyle or CounterReset
+	Logger        Logger          `json:"-" yaml:"-"`
+	OnStateChange func(ConnState) `json:"-" yaml:"-"`
+}
+
+// jsonConfig is the JSON representation of Config, with durations as strings
+type jsonConfig struct {
+	*plainConfig
+	Timeout               string `json:"timeout,omitempty"`
+	ConnectRetryDelay     string `json:"connect_retry_delay,omitempty"`
+	FallbackRetryInterval string `json:"fallback_retry_interval,omitempty"`
+	MinFlushInterval      string `json:"min_flush_interval,omitempty"`
+	AutoFlushInterval     string `json:"auto_flush_interval,omitempty"`
+	MaxConnectionAge      string `json:"max_connection_age,omitempty"`
+	OpTimeout             string `json:"op_timeout,omitempty"`
+	TimestampOffset       string `json:"timestamp_offset,omitempty"`
+	CoalesceWindow        string `json:"coalesce_window,omitempty"`
+}
+
+// plainConfig has the same fields as Config but not its JSON methods
+type plainConfig Config
+
+// MarshalJSON implements json.Marshaler, writing durations as strings
+func (cfg Config) MarshalJSON() ([]byte, error) {
+	aux := jsonConfig{plainConfig: (*plainConfig)(&cfg)}
+	aux.Timeout = durationString(cfg.Timeout)
+	aux.ConnectRetryDelay = durationString(cfg.ConnectRetryDelay)
+	aux.FallbackRetryInterval = durationString(cfg.FallbackRetryInterval)
+	aux.MinFlushInterval = durationString(cfg.MinFlushInterval)
+	aux.AutoFlushInterval = durationString(cfg.AutoFlushInterval)
+	aux.MaxConnectionAge = durationString(cfg.MaxConnectionAge)
+	aux.OpTimeout = durationString(cfg.OpTimeout)
+	aux.TimestampOffset = durationString(cfg.TimestampOffset)
+	aux.CoalesceWindow = durationString(cfg.CoalesceWindow)
+	return json.Marshal(aux)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, parsing durations from strings
+func (cfg *Config) UnmarshalJSON(data []byte) error {
+	aux := jsonConfig{plainConfig: (*plainConfig)(cfg)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if err := parseDuration("timeout", aux.Timeout, &cfg.Timeout); err != nil {
+		return err
+	}
+	if err := parseDuration("connect_retry_delay", aux.ConnectRetryDelay, &cfg.ConnectRetryDelay); err != nil {
+		return err
+	}
+	if err := parseDuration("fallback_retry_interval", aux.FallbackRetryInterval, &cfg.FallbackRetryInterval); err != nil {
+		return err
+	}
+	if err := parseDuration("min_flush_interval", aux.MinFlushInterval, &cfg.MinFlushInterval); err != nil {
+		return err
+	}
+	if err := parseDuration("auto_flush_interval", aux.AutoFlushInterval, &cfg.AutoFlushInterval); err != nil {
+		return err
+	}
+	if err := parseDuration("max_connection_age", aux.MaxConnectionAge, &cfg.MaxConnectionAge); err != nil {
+		return err
+	}
+	if err := parseDuration("op_timeout", aux.OpTimeout, &cfg.OpTimeout); err != nil {
+		return err
+	}
+	if err := parseDuration("timestamp_offset", aux.TimestampOffset, &cfg.TimestampOffset); err != nil {
+		return err
+	}
+	return parseDuration("coalesce_window", aux.CoalesceWindow, &cfg.CoalesceWindow)
+}
+
+// durationString formats d for JSON, omitting zero durations
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// parseDuration parses the value of the JSON field called name into d, if
+// the field is present
+func parseDuration(name, value string, d *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("graphite: invalid %s %q: %v", name, value, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// LoadConfig reads a JSON encoded Config from r
+func LoadConfig(r io.Reader) (Config, error) {
+	var cfg Config
+	err := json.NewDecoder(r).Decode(&cfg)
+	return cfg, err
+}
+
+// NewGraphiteFromConfig is a factory method that's used to create a new
+// Graphite from a Config. Like GraphiteFactory, it rejects an empty Host or an
+// out of range Port for every protocol, nop included.
+func NewGraphiteFromConfig(cfg Config) (*Graphite, error) {
+	graphite := &Graphite{
+		Host:                  cfg.Host,
+		Port:                  cfg.Port,
+		Protocol:              cfg.Protocol,
+		Timeout:               cfg.Timeout,
+		Prefix:                cfg.Prefix,
+		DisableLog:            cfg.DisableLog,
+		ConnectRetries:        cfg.ConnectRetries,
+		ConnectRetryDelay:     cfg.ConnectRetryDelay,
+		CheckConnBeforeSend:   cfg.CheckConnBeforeSend,
+		SendInterval:          cfg.SendInterval,
+		NoDelay:               cfg.NoDelay,
+		BufferSize:            cfg.BufferSize,
+		ManualFlush:           cfg.ManualFlush,
+		MinFlushInterval:      cfg.MinFlushInterval,
+		AutoFlushInterval:     cfg.AutoFlushInterval,
+		MaxConnectionAge:      cfg.MaxConnectionAge,
+		OpTimeout:             cfg.OpTimeout,
+		TimestampOffset:       cfg.TimestampOffset,
+		TimestampOffsetAll:    cfg.TimestampOffsetAll,
+		MaxLineLength:         cfg.MaxLineLength,
+		MaxNameSegments:       cfg.MaxNameSegments,
+		Debug:                 cfg.Debug,
+		MaxDatagramSize:       cfg.MaxDatagramSize,
+		MaxMetricsPerDatagram: cfg.MaxMetricsPerDatagram,
+		UDPSendBuffer:         cfg.UDPSendBuffer,
+		UDPReceiveBuffer:      cfg.UDPReceiveBuffer,
+		AutoReconnect:         cfg.AutoReconnect,
+		TCPFallback:           cfg.TCPFallback,
+		Linger:                cfg.Linger,
+		Logger:                cfg.Logger,
+		OnStateChange:         cfg.OnStateChange,
+
+		UseBatchTimestamp:       cfg.UseBatchTimestamp,
+		CoalesceWindow:          cfg.CoalesceWindow,
+		FlushBytesThreshold:     cfg.FlushBytesThreshold,
+		ReportFlushCount:        cfg.ReportFlushCount,
+		ReportDropped:           cfg.ReportDropped,
+		RetainRecent:            cfg.RetainRecent,
+		NopLogSampleRate:        cfg.NopLogSampleRate,
+		ValidateMetrics:         cfg.ValidateMetrics,
+		ClampNegativeTimestamps: cfg.ClampNegativeTimestamps,
+		UnitSuffix:              cfg.UnitSuffix,
+		FailOnMalformed:         cfg.FailOnMalformed,
+		DefaultTags:             cfg.DefaultTags,
+	}
+	if graphite.Port == 0 {
+		graphite.Port = defaultPort
+	}
+
+	switch graphite.Protocol {
+	case "", "tcp", "udp":
+		if graphite.Protocol == "" {
+			graphite.Protocol = "tcp"
+		}
+	case "nop":
+		graphite.Protocol = ""
+		graphite.nop = true
+	default:
+		return nil, fmt.Errorf("graphite: unsupported protocol %q", cfg.Protocol)
+	}
+	if err := validateAddress(graphite.Host, graphite.Port); err != nil {
+		return nil, err
+	}
+
+	err := graphite.Connect()
+	if err != nil {
+		if !cfg.FallbackToNop {
+			return nil, err
+		}
+		graphite.logf("Graphite: can't connect to %s:%d, falling back to nop: %v", graphite.Host, graphite.Port, err)
+		graphite.mu.Lock()
+		graphite.nop = true
+		graphite.setState(StateNop)
+		if cfg.FallbackRetryInterval > 0 {
+			graphite.retryConnect(cfg.FallbackRetryInterval)
+		}
+		graphite.mu.Unlock()
+	}
+
+	return graphite, nil
+}
+
+// NewGraphiteFromEnv is a factory method that's used to create a new Graphite
+// configured from the GRAPHITE_HOST, GRAPHITE_PORT, GRAPHITE_PROTOCOL,
+// GRAPHITE_PREFIX and GRAPHITE_TIMEOUT environment variables. GRAPHITE_HOST is
+// required, GRAPHITE_TIMEOUT is a duration such as "3s" and the other
+// variables default like the matching Config fields.
+func NewGraphiteFromEnv() (*Graphite, error) {
+	cfg, err := configFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewGraphiteFromConfig(cfg)
+}
+
+func configFromEnv() (Config, error) {
+	cfg := Config{
+		Host:     os.Getenv("GRAPHITE_HOST"),
+		Protocol: os.Getenv("GRAPHITE_PROTOCOL"),
+		Prefix:   os.Getenv("GRAPHITE_PREFIX"),
+	}
+	if cfg.Host == "" {
+		return cfg, errors.New("graphite: GRAPHITE_HOST is not set")
+	}
+	if port := os.Getenv("GRAPHITE_PORT"); port != "" {
+		var err error
+		cfg.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return cfg, fmt.Errorf("graphite: invalid GRAPHITE_PORT %q: %v", port, err)
+		}
+	}
+	if timeout := os.Getenv("GRAPHITE_TIMEOUT"); timeout != "" {
+		var err error
+		cfg.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return cfg, fmt.Errorf("graphite: invalid GRAPHITE_TIMEOUT %q: %v", timeout, err)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,303 @@
+package graphite
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewGraphiteFromConfig(t *testing.T) {
+	srv := newTestServer(t)
+	cfg := Config{
+		Host:                "127.0.0.1",
+		Port:                srv.Port(),
+		Protocol:            TCP,
+		Timeout:             3 * time.Second,
+		Prefix:              "app",
+		DisableLog:          true,
+		CheckConnBeforeSend: true,
+		MinFlushInterval:    time.Second,
+		AutoFlushInterval:   time.Minute,
+		MaxConnectionAge:    time.Hour,
+		OpTimeout:           2 * time.Second,
+		TimestampOffset:     time.Minute,
+	}
+
+	gr, err := NewGraphiteFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+
+	if gr.Host != cfg.Host || gr.Port != cfg.Port || gr.Protocol != cfg.Protocol {
+		t.Errorf("Wrong address: %s://%s:%d", gr.Protocol, gr.Host, gr.Port)
+	}
+	if gr.Timeout != cfg.Timeout {
+		t.Errorf("Wrong timeout: %v", gr.Timeout)
+	}
+	if gr.Prefix != cfg.Prefix || !gr.DisableLog || !gr.CheckConnBeforeSend {
+		t.Errorf("Wrong settings: %#v", gr)
+	}
+	if gr.MinFlushInterval != cfg.MinFlushInterval || gr.AutoFlushInterval != cfg.AutoFlushInterval ||
+		gr.MaxConnectionAge != cfg.MaxConnectionAge || gr.OpTimeout != cfg.OpTimeout {
+		t.Errorf("Wrong flush and connection settings: %#v", gr)
+	}
+	if gr.TimestampOffset != cfg.TimestampOffset {
+		t.Errorf("Wrong timestamp offset: %v", gr.TimestampOffset)
+	}
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "app.foo 1 1500000000\n")
+}
+
+func TestNewGraphiteFromConfigDefaults(t *testing.T) {
+	gr, err := NewGraphiteFromConfig(Config{
+		Host:               "localhost",
+		Protocol:           NOP,
+		ManualFlush:        true,
+		TimestampOffsetAll: true,
+		RetainRecent:       10,
+		ReportFlushCount:   true,
+		ReportDropped:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gr.IsNop() {
+		t.Error("GraphiteHost is not NOP")
+	}
+	if !gr.ManualFlush || !gr.TimestampOffsetAll || gr.RetainRecent != 10 || !gr.ReportFlushCount || !gr.ReportDropped {
+		t.Errorf("Wrong settings: %#v", gr)
+	}
+	if gr.Port != defaultPort {
+		t.Errorf("Wrong default port: %d", gr.Port)
+	}
+
+	if _, err := NewGraphiteFromConfig(Config{Protocol: "carrier-pigeon"}); err == nil {
+		t.Error("Unsupported protocol did not return an error")
+	}
+}
+
+func TestNewGraphiteFromEnv(t *testing.T) {
+	srv := newTestServer(t)
+	t.Setenv("GRAPHITE_HOST", "127.0.0.1")
+	t.Setenv("GRAPHITE_PORT", strconv.Itoa(srv.Port()))
+	t.Setenv("GRAPHITE_PROTOCOL", TCP)
+	t.Setenv("GRAPHITE_PREFIX", "env")
+	t.Setenv("GRAPHITE_TIMEOUT", "3s")
+
+	gr, err := NewGraphiteFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+
+	if gr.Port != srv.Port() || gr.Prefix != "env" || gr.Timeout != 3*time.Second {
+		t.Errorf("Wrong settings: %#v", gr)
+	}
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "env.foo 1 1500000000\n")
+}
+
+func TestNewGraphiteFromEnvErrors(t *testing.T) {
+	t.Setenv("GRAPHITE_HOST", "")
+	if _, err := NewGraphiteFromEnv(); err == nil {
+		t.Error("Missing GRAPHITE_HOST did not return an error")
+	}
+
+	t.Setenv("GRAPHITE_HOST", "127.0.0.1")
+	t.Setenv("GRAPHITE_PORT", "port")
+	if _, err := NewGraphiteFromEnv(); err == nil || !strings.Contains(err.Error(), "GRAPHITE_PORT") {
+		t.Errorf("Invalid GRAPHITE_PORT returned %v", err)
+	}
+
+	t.Setenv("GRAPHITE_PORT", "2003")
+	t.Setenv("GRAPHITE_TIMEOUT", "soon")
+	if _, err := NewGraphiteFromEnv(); err == nil || !strings.Contains(err.Error(), "GRAPHITE_TIMEOUT") {
+		t.Errorf("Invalid GRAPHITE_TIMEOUT returned %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(`{
+		"host": "graphite.example.com",
+		"port": 2013,
+		"protocol": "udp",
+		"timeout": "3s",
+		"fallback_retry_interval": "1m",
+		"connect_retry_delay": "250ms",
+		"prefix": "app",
+		"disable_log": true,
+		"manual_flush": true,
+		"min_flush_interval": "100ms",
+		"auto_flush_interval": "10s",
+		"max_connection_age": "1h",
+		"op_timeout": "2s",
+		"timestamp_offset": "-90s",
+		"timestamp_offset_all": true,
+		"use_batch_timestamp": true,
+		"coalesce_window": "5ms",
+		"flush_bytes_threshold": 1024,
+		"report_flush_count": true,
+		"report_dropped": true,
+		"retain_recent": 50,
+		"nop_log_sample_rate": 0.1,
+		"validate_metrics": true,
+		"clamp_negative_timestamps": true,
+		"unit_suffix": true,
+		"fail_on_malformed": true,
+		"default_tags": {"env": "prod"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{
+		Host:       "graphite.example.com",
+		Port:       2013,
+		Protocol:   UDP,
+		Timeout:    3 * time.Second,
+		Prefix:     "app",
+		DisableLog: true,
+
+		ConnectRetryDelay:     250 * time.Millisecond,
+		FallbackRetryInterval: time.Minute,
+		ManualFlush:           true,
+		MinFlushInterval:      100 * time.Millisecond,
+		AutoFlushInterval:     10 * time.Second,
+		MaxConnectionAge:      time.Hour,
+		OpTimeout:             2 * time.Second,
+		TimestampOffset:       -90 * time.Second,
+		TimestampOffsetAll:    true,
+
+		UseBatchTimestamp:       true,
+		CoalesceWindow:          5 * time.Millisecond,
+		FlushBytesThreshold:     1024,
+		ReportFlushCount:        true,
+		ReportDropped:           true,
+		RetainRecent:            50,
+		NopLogSampleRate:        0.1,
+		ValidateMetrics:         true,
+		ClampNegativeTimestamps: true,
+		UnitSuffix:              true,
+		FailOnMalformed:         true,
+		DefaultTags:             map[string]string{"env": "prod"},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Loaded %#v, expected %#v", cfg, expected)
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"timeout":"3s"`) {
+		t.Errorf("Timeout not marshalled as a string: %s", data)
+	}
+	roundTrip, err := LoadConfig(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, cfg) {
+		t.Errorf("Round trip produced %#v, expected %#v", roundTrip, cfg)
+	}
+
+	if _, err := LoadConfig(strings.NewReader(`{"timeout": "soon"}`)); err == nil {
+		t.Error("Invalid timeout did not return an error")
+	}
+}
+
+func TestFallbackToNop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := Config{Host: "127.0.0.1", Port: closedPort}
+	if _, err := NewGraphiteFromConfig(cfg); err == nil {
+		t.Error("Connecting to a closed port did not return an error")
+	}
+
+	logger := &testLogger{}
+	cfg.FallbackToNop = true
+	cfg.DisableLog = true
+	cfg.Logger = logger
+	gr, err := NewGraphiteFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gr.IsNop() {
+		t.Error("Graphite did not fall back to nop")
+	}
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if lines := logger.Lines(); len(lines) != 1 || !strings.Contains(lines[0], "falling back to nop") {
+		t.Errorf("Unexpected log output %q", lines)
+	}
+}
+
+func TestFallbackToNopRecovery(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	states := make(chan ConnState, 2)
+	gr, err := NewGraphiteFromConfig(Config{
+		Host:                  "127.0.0.1",
+		Port:                  port,
+		FallbackToNop:         true,
+		FallbackRetryInterval: 10 * time.Millisecond,
+		Logger:                &testLogger{},
+		OnStateChange:         func(state ConnState) { states <- state },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Close()
+	if state := <-states; state != StateNop {
+		t.Errorf("First state is %v", state)
+	}
+
+	// carbon comes up late, on the same port
+	listener, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skip("Can't listen again on the same port: ", err)
+	}
+	srv := &testServer{listener: listener}
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			srv.serve(conn)
+		}
+	}()
+	defer listener.Close()
+
+	select {
+	case state := <-states:
+		if state != StateConnected {
+			t.Errorf("Second state is %v", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Graphite did not reconnect")
+	}
+	if gr.IsNop() {
+		t.Error("Graphite is still nop")
+	}
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "foo 1 1500000000\n")
+}
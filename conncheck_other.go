@@ -0,0 +1,28 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graphite
+
+import (
+	"net"
+	"time"
+)
+
+// connIsAlive probes the connection with a very short read: a healthy
+// connection times out, while one closed or reset by the peer reports EOF or
+// another error
+func connIsAlive(conn net.Conn) bool {
+	var probe [1]byte
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(probe[:])
+	conn.SetReadDeadline(time.Time{})
+
+	if err == nil {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
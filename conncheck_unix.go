@@ -0,0 +1,36 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graphite
+
+import (
+	"net"
+	"syscall"
+)
+
+// connIsAlive peeks at the socket without blocking: a healthy connection has
+// nothing to read, while one closed or reset by the peer reports EOF or an
+// error
+func connIsAlive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+
+	alive := true
+	var probe [1]byte
+	raw.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), probe[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK:
+		case err != nil || n == 0:
+			alive = false
+		}
+		return true
+	})
+	return alive
+}
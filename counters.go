@@ -0,0 +1,121 @@
+package graphite
+
+import (
+	"time"
+)
+
+// CounterResetPolicy controls what SendRate and SendCounterDelta do when a
+// counter decreases, which usually means the process owning it restarted
+type CounterResetPolicy int
+
+const (
+	// SkipCounterReset sends nothing for the observation after a reset
+	SkipCounterReset CounterResetPolicy = iota
+	// ZeroCounterReset sends zero for the observation after a reset
+	ZeroCounterReset
+)
+
+// observation is the last value seen for a counter and when it was seen
+type observation struct {
+	value float64
+	time  time.Time
+}
+
+// SimpleSendInt sends an integer value with the current timestamp
+func (graphite *Graphite) SimpleSendInt(stat string, value int64) error {
+	metrics := []Metric{NewMetricInt(stat, value, graphite.timestampNow().Unix())}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
+
+// Incr adds delta to the client-side counter called name and sends its new
+// value. Counters start at zero and live as long as the client.
+func (graphite *Graphite) Incr(name string, delta int64) error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	if graphite.counters == nil {
+		graphite.counters = make(map[string]int64)
+	}
+	graphite.counters[name] += delta
+	metrics := []Metric{NewMetricInt(name, graphite.counters[name], graphite.timestampNow().Unix())}
+	return graphite.sendMetrics(metrics)
+}
+
+// Decr subtracts delta from the client-side counter called name and sends its
+// new value
+func (graphite *Graphite) Decr(name string, delta int64) error {
+	return graphite.Incr(name, -delta)
+}
+
+// SendRate sends the per-second rate of change of the monotonic counter called
+// name, computed from counterValue and the previous value passed for name,
+// with timestamp t (the current time if zero). The first observation of a
+// counter only records it. When the counter decreases, CounterReset decides
+// whether a zero rate is sent or nothing.
+func (graphite *Graphite) SendRate(name string, counterValue float64, t time.Time) error {
+	if t.IsZero() {
+		t = graphite.timestampNow()
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	if graphite.observations == nil {
+		graphite.observations = make(map[string]observation)
+	}
+	previous, seen := graphite.observations[name]
+	graphite.observations[name] = observation{value: counterValue, time: t}
+	if !seen {
+		return nil
+	}
+	elapsed := t.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+
+	rate := (counterValue - previous.value) / elapsed
+	if rate < 0 {
+		if graphite.CounterReset == SkipCounterReset {
+			return nil
+		}
+		rate = 0
+	}
+	return graphite.sendMetrics([]Metric{NewMetricFloat(name, rate, t.Unix())})
+}
+
+// SendCounterDelta sends how much the monotonic counter called name increased
+// since the previous value passed for name, e.g. the bytes received by a
+// network interface since the last poll, with timestamp t (the current time
+// if zero). The first observation of a counter only records it. When the
+// counter decreases, CounterReset decides whether a zero delta is sent or
+// nothing.
+func (graphite *Graphite) SendCounterDelta(name string, value float64, t time.Time) error {
+	if t.IsZero() {
+		t = graphite.timestampNow()
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	if graphite.lastCounters == nil {
+		graphite.lastCounters = make(map[string]float64)
+	}
+	previous, seen := graphite.lastCounters[name]
+	graphite.lastCounters[name] = value
+	if !seen {
+		return nil
+	}
+
+	delta := value - previous
+	if delta < 0 {
+		if graphite.CounterReset == SkipCounterReset {
+			return nil
+		}
+		delta = 0
+	}
+	return graphite.sendMetrics([]Metric{NewMetricFloat(name, delta, t.Unix())})
+}
@@ -0,0 +1,165 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentValues returns the value of each line written to buf
+func sentValues(buf *bytes.Buffer) []string {
+	var values []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			values = append(values, fields[0]+"="+fields[1])
+		}
+	}
+	return values
+}
+
+func TestSimpleSendInt(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+
+	if err := gr.SimpleSendInt("foo", 1234567890123); err != nil {
+		t.Error(err)
+	}
+	if values := sentValues(&buf); fmt.Sprint(values) != "[foo=1234567890123]" {
+		t.Errorf("Sent %q", values)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+
+	gr.Incr("foo", 1)
+	gr.Incr("foo", 2)
+	gr.Incr("bar", 5)
+	gr.Decr("foo", 4)
+	if values := sentValues(&buf); fmt.Sprint(values) != "[foo=1 foo=3 bar=5 foo=-1]" {
+		t.Errorf("Sent %q", values)
+	}
+
+	buf.Reset()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gr.Incr("concurrent", 1)
+		}()
+	}
+	wg.Wait()
+	if values := sentValues(&buf); len(values) != 50 || values[49] != "concurrent=50" {
+		t.Errorf("Sent %q", values)
+	}
+}
+
+func TestSendRate(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	start := time.Unix(1500000000, 0)
+
+	gr.SendRate("rx_bytes", 1000, start)
+	if buf.Len() != 0 {
+		t.Errorf("First observation sent %q", buf.String())
+	}
+	gr.SendRate("rx_bytes", 4000, start.Add(10*time.Second))
+	gr.SendRate("tx_bytes", 10, start.Add(10*time.Second))
+	gr.SendRate("rx_bytes", 4500, start.Add(20*time.Second))
+	expected := "rx_bytes 300 1500000010\nrx_bytes 50 1500000020\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendRateCounterReset(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	start := time.Unix(1500000000, 0)
+
+	gr.SendRate("rx_bytes", 1000, start)
+	gr.SendRate("rx_bytes", 100, start.Add(10*time.Second))
+	gr.SendRate("rx_bytes", 300, start.Add(20*time.Second))
+	if expected := "rx_bytes 20 1500000020\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	gr.CounterReset = ZeroCounterReset
+	gr.SendRate("rx_bytes", 0, start.Add(30*time.Second))
+	if expected := "rx_bytes 0 1500000030\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendCounterDelta(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	start := time.Unix(1500000000, 0)
+
+	gr.SendCounterDelta("rx_bytes", 1000, start)
+	if buf.Len() != 0 {
+		t.Errorf("First observation sent %q", buf.String())
+	}
+	gr.SendCounterDelta("rx_bytes", 4000, start.Add(10*time.Second))
+	gr.SendCounterDelta("tx_bytes", 10, start.Add(10*time.Second))
+	gr.SendCounterDelta("rx_bytes", 4500, start.Add(20*time.Second))
+	expected := "rx_bytes 3000 1500000010\nrx_bytes 500 1500000020\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendCounterDeltaReset(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	start := time.Unix(1500000000, 0)
+
+	gr.SendCounterDelta("rx_bytes", 1000, start)
+	gr.SendCounterDelta("rx_bytes", 100, start.Add(10*time.Second))
+	gr.SendCounterDelta("rx_bytes", 300, start.Add(20*time.Second))
+	if expected := "rx_bytes 200 1500000020\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	gr.CounterReset = ZeroCounterReset
+	gr.SendCounterDelta("rx_bytes", 0, start.Add(30*time.Second))
+	if expected := "rx_bytes 0 1500000030\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendCounterDeltaConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	start := time.Unix(1500000000, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for j := 0; j <= 100; j++ {
+				gr.SendCounterDelta(name, float64(j*10), start.Add(time.Duration(j)*time.Second))
+			}
+		}(fmt.Sprintf("counter%d", i))
+	}
+	wg.Wait()
+
+	values := sentValues(&buf)
+	if len(values) != 400 {
+		t.Fatalf("Sent %d deltas, expected 400", len(values))
+	}
+	for _, value := range values {
+		if !strings.HasSuffix(value, "=10") {
+			t.Errorf("Sent %s, expected deltas of 10", value)
+			break
+		}
+	}
+}
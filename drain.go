@@ -0,0 +1,36 @@
+package graphite
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks the socket send queue
+const drainPollInterval = 5 * time.Millisecond
+
+// Drain flushes the buffered metrics and, for TCP connections, waits until
+// the peer has acknowledged all the data in the socket send queue, or ctx is
+// done, so that short-lived programs can exit without losing metrics. Checking
+// the send queue is only supported on Linux; elsewhere Drain returns after the
+// flush. The client is locked while Drain waits.
+func (graphite *Graphite) Drain(ctx context.Context) error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	if err := graphite.flush(); err != nil {
+		return err
+	}
+	if graphite.conn == nil || graphite.Protocol == "udp" {
+		return nil
+	}
+	for {
+		if unsent, ok := unsentBytes(graphite.conn); !ok || unsent == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
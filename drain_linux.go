@@ -0,0 +1,30 @@
+package graphite
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// unsentBytes returns the number of bytes in the send queue of conn, sent or
+// not but not yet acknowledged by the peer, using the SIOCOUTQ ioctl
+func unsentBytes(conn net.Conn) (int, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var queued int32
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&queued)))
+	})
+	if err != nil || errno != 0 {
+		return 0, false
+	}
+	return int(queued), true
+}
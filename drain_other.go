@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package graphite
+
+import (
+	"net"
+)
+
+// unsentBytes can't inspect the send queue on this OS
+func unsentBytes(conn net.Conn) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,24 @@
+package graphite
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.ManualFlush = true
+
+	gr.SendMetrics(testMetrics(2))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := gr.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if unsent, ok := unsentBytes(gr.conn); ok && unsent != 0 {
+		t.Errorf("%d bytes still queued after Drain", unsent)
+	}
+	srv.waitForData(t, "foo 0 1500000000\nfoo 1 1500000000\n")
+}
@@ -0,0 +1,69 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DuplicateTimestampPolicy is what a client does with a batch that has more
+// than one point for the same series and timestamp, see
+// Graphite.DuplicateTimestampPolicy
+type DuplicateTimestampPolicy int
+
+const (
+	// DuplicateIgnore sends all the points, carbon keeps the last one
+	DuplicateIgnore DuplicateTimestampPolicy = iota
+	// DuplicateDedup only sends the last point of each series and timestamp
+	DuplicateDedup
+	// DuplicateError sends nothing and returns an ErrDuplicateTimestamp
+	// error naming the series that collided
+	DuplicateError
+)
+
+// ErrDuplicateTimestamp is returned for batches with more than one point for
+// the same series and timestamp when the policy is DuplicateError
+var ErrDuplicateTimestamp = errors.New("graphite: duplicate series and timestamp in batch")
+
+// seriesKey identifies the series of metric and its timestamp, metrics without
+// a timestamp all share the same one
+func seriesKey(metric Metric) string {
+	return metric.Name + metric.tagString() + " " + strconv.FormatInt(metric.Timestamp, 10)
+}
+
+// applyDuplicatePolicy returns metrics, without the duplicate points when the
+// policy is DuplicateDedup, or an error if there are duplicates and the policy
+// is DuplicateError
+func (graphite *Graphite) applyDuplicatePolicy(metrics []Metric) ([]Metric, error) {
+	if graphite.DuplicateTimestampPolicy == DuplicateIgnore || len(metrics) < 2 {
+		return metrics, nil
+	}
+
+	last := make(map[string]int, len(metrics))
+	var collisions []string
+	for i, metric := range metrics {
+		if metric.Name == "" {
+			continue
+		}
+		key := seriesKey(metric)
+		if _, ok := last[key]; ok {
+			collisions = append(collisions, key)
+		}
+		last[key] = i
+	}
+	if len(collisions) == 0 {
+		return metrics, nil
+	}
+	if graphite.DuplicateTimestampPolicy == DuplicateError {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateTimestamp, strings.Join(collisions, ", "))
+	}
+
+	deduped := make([]Metric, 0, len(last))
+	for i, metric := range metrics {
+		if metric.Name != "" && last[seriesKey(metric)] == i {
+			deduped = append(deduped, metric)
+		}
+	}
+	return deduped, nil
+}
@@ -0,0 +1,43 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	metrics := []Metric{
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("bar", "2", 1500000000),
+		NewMetric("foo", "3", 1500000000),
+		NewMetric("foo", "4", 1500000060),
+		NewMetric("bar", "5", 1500000000).WithTag("region", "us"),
+	}
+	tests := []struct {
+		policy   DuplicateTimestampPolicy
+		expected string
+	}{
+		{DuplicateIgnore, "foo 1 1500000000\nbar 2 1500000000\nfoo 3 1500000000\nfoo 4 1500000060\nbar;region=us 5 1500000000\n"},
+		{DuplicateDedup, "bar 2 1500000000\nfoo 3 1500000000\nfoo 4 1500000060\nbar;region=us 5 1500000000\n"},
+		{DuplicateError, ""},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		gr := NewGraphiteWriter(&buf, "")
+		gr.DuplicateTimestampPolicy = test.policy
+
+		err := gr.SendMetrics(metrics)
+		if test.policy == DuplicateError {
+			if !errors.Is(err, ErrDuplicateTimestamp) || !strings.Contains(err.Error(), "foo 1500000000") {
+				t.Errorf("Unexpected error %v", err)
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Wrote %q with policy %d, expected %q", buf.String(), test.policy, test.expected)
+		}
+	}
+}
@@ -2,9 +2,18 @@ package graphite
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,31 +26,455 @@ type Graphite struct {
 	Timeout    time.Duration
 	Prefix     string
 	conn       net.Conn
+	sink       io.Writer
+	writer     *bufio.Writer
 	nop        bool
 	DisableLog bool
+	// NopLogSampleRate, when between 0 and 1, makes nop mode log only that
+	// fraction of the metrics, picked at random, so that busy clients don't
+	// flood the logs. Zero logs every metric.
+	NopLogSampleRate float64
+	// CheckConnBeforeSend makes every send probe the TCP connection first
+	// and reconnect if the peer has closed it. This costs an extra syscall
+	// per send, so it's disabled by default.
+	CheckConnBeforeSend bool
+	// SendInterval appends the Interval of metrics that have one as a fourth
+	// field of the line, "name value timestamp interval", for relays that
+	// use it as a step hint
+	SendInterval bool
+	// NoDelay disables Nagle's algorithm on TCP connections, so that small
+	// writes go out immediately at the cost of sending more packets. Go
+	// already does this for new connections, the option makes it explicit
+	// and independent of the runtime defaults.
+	NoDelay bool
+	// BufferSize is the size in bytes of the buffer that collects the lines
+	// of TCP and writer clients before they are written out, 4096 if zero.
+	// Smaller values are raised to 512; lines longer than the buffer are
+	// written directly. It applies to the connections made after it's set.
+	BufferSize int
+	// ConnectRetries is the number of times Connect retries a failed dial
+	// before returning the error, waiting ConnectRetryDelay (100ms if zero)
+	// before the first retry and doubling the wait each time. It helps when
+	// carbon may not be listening yet at startup. Reconnections made while
+	// sending only try once, so that sends don't wait for the backoff.
+	ConnectRetries    int
+	ConnectRetryDelay time.Duration
+	// MaxConnectionAge makes a send reconnect first when the connection is
+	// older than this, for networks where NAT gateways silently drop long
+	// lived connections. Zero keeps connections as long as they work.
+	MaxConnectionAge time.Duration
+	// Linger, when set, is passed to SetLinger on TCP connections, deciding
+	// what closing the connection does with data the kernel hasn't sent yet.
+	// With a negative value, the OS default, Close returns at once and the
+	// data is sent in the background; with 0 it's discarded and the
+	// connection reset, losing data but never blocking; with a positive
+	// value the data is sent for up to that many seconds and then discarded,
+	// and on some systems, including Linux, closing blocks meanwhile. Since
+	// Close, Disconnect, Reset and the reconnections made by sends close the
+	// connection with the client locked, they may then block it for up to
+	// Linger seconds.
+	Linger *int
+	// OpTimeout bounds the total time of a send, across all the flushes of
+	// a large batch and any reconnections: when it expires the remaining
+	// metrics aren't written and the send returns context.DeadlineExceeded.
+	// A reconnection in progress is abandoned, but a flush in progress isn't
+	// interrupted, so a send can overrun it by the duration of one flush.
+	// Zero means no limit.
+	OpTimeout time.Duration
+	// MaxLineLength drops metrics whose line, excluding the newline, is
+	// longer than this many bytes instead of letting carbon truncate them.
+	// Zero means no limit.
+	MaxLineLength int
+	// MaxNameSegments drops metrics whose name, prefix included, has more
+	// than this many dot-separated segments, to guard against unsanitized
+	// IDs creating huge whisper trees. Zero means no limit.
+	MaxNameSegments int
+	// ReportFlushCount adds to every flush of a TCP or writer client a
+	// graphite.flush.count metric, under the client prefix, with the number
+	// of metrics in the flush, not counting itself
+	ReportFlushCount bool
+	// ManualFlush makes a TCP or writer client keep the metrics it's sent in
+	// memory until Flush, Disconnect or Close is called, rather than writing
+	// them at the end of each send or when the buffer fills up. Memory grows
+	// with every metric sent until the next Flush, so callers must flush
+	// regularly.
+	ManualFlush bool
+	// ReportDropped adds to the flushes of a TCP or writer client that follow
+	// metrics being dropped, e.g. by MaxLineLength or MetricFilter, a
+	// graphite.dropped metric, under the client prefix, with the number of
+	// metrics dropped since the last report
+	ReportDropped bool
+	// MinFlushInterval makes sends flush the buffer at most once per interval,
+	// to save syscalls when sending single metrics in a tight loop. Metrics
+	// sent in between stay buffered until the first send after the interval,
+	// a Flush, Disconnect or Close, or until the buffer fills up.
+	MinFlushInterval time.Duration
+	// AutoFlushInterval makes a TCP or writer client flush the metrics left
+	// in the buffer, e.g. by ManualFlush or MinFlushInterval, every interval
+	// from a background goroutine, so that they aren't held indefinitely when
+	// no more sends come. The goroutine starts with the first send after it's
+	// set, or after a reconnection, and stops on Disconnect and Close.
+	AutoFlushInterval time.Duration
+	// FlushBytesThreshold flushes the buffer during a send as soon as it
+	// holds at least this many bytes, e.g. to match the chunk size preferred
+	// by a relay. Zero only flushes when the buffer is full and at the end of
+	// each send.
+	FlushBytesThreshold int
+	// TimestampOffset is added to the current time whenever the client picks
+	// the timestamp of a metric, e.g. for metrics without one, to make up for
+	// hosts whose clocks are known to be off by a fixed amount. Timestamps
+	// set by the caller are sent as they are, unless TimestampOffsetAll is
+	// set.
+	TimestampOffset time.Duration
+	// TimestampOffsetAll applies TimestampOffset to the timestamps set by the
+	// caller as well, for callers that take them from the same skewed clock.
+	// Leave it unset when they come from elsewhere, e.g. a replayed log.
+	TimestampOffsetAll bool
+	// UseBatchTimestamp gives all the metrics without a timestamp in a send
+	// the same one, taken once at the start of the send, rather than the time
+	// each is written, so that a batch can't straddle a second boundary
+	UseBatchTimestamp bool
+	// CoalesceWindow makes SendMetric wait up to this long for other
+	// goroutines calling it, and send all their metrics as one batch with a
+	// single flush. Each call still returns the error of its batch. It trades
+	// latency for throughput when many goroutines send single metrics; a
+	// window well below a millisecond is usually enough.
+	CoalesceWindow time.Duration
+	// OnSendError, when set, is called with the reason a metric was dropped.
+	// It's called with the client locked, so it must not use the client.
+	OnSendError func(error)
+	// MaxDatagramSize packs several metrics into each UDP datagram, up to
+	// this many bytes; lines longer than it are sent on their own
+	MaxDatagramSize int
+	// MaxMetricsPerDatagram packs up to this many metrics into each UDP
+	// datagram, whichever of the two limits is hit first ends a datagram.
+	// When both are zero each metric is sent in its own datagram, and when
+	// only this is set datagrams are kept within a 1500 bytes MTU.
+	MaxMetricsPerDatagram int
+	// UDPSendBuffer and UDPReceiveBuffer set the size in bytes of the socket
+	// buffers (SO_SNDBUF and SO_RCVBUF) of UDP connections. A larger send
+	// buffer reduces the datagrams dropped by the kernel during bursts. The
+	// OS may cap the value: e.g. Linux limits it to net.core.wmem_max and
+	// net.core.rmem_max without reporting an error.
+	UDPSendBuffer    int
+	UDPReceiveBuffer int
+	// TCPFallback makes a UDP client send the lines that don't fit in a
+	// datagram of MaxDatagramSize bytes over TCP, to the same host and port,
+	// instead of in a datagram that may be fragmented or dropped. Each send
+	// with such lines opens and closes a TCP connection, so it's only meant
+	// for the occasional oversized metric.
+	TCPFallback bool
+	// AutoReconnect makes a UDP client resolve and dial the address again,
+	// and retry the datagram once, when a write fails because an earlier
+	// datagram was refused with an ICMP port unreachable, so that it recovers
+	// when the relay restarts
+	AutoReconnect bool
+	// Tee, when set, receives a copy of every line sent to the network, e.g.
+	// os.Stdout to see what's being sent while debugging. Unlike nop mode the
+	// metrics are still sent, and unlike NewGraphiteWriter the network isn't
+	// replaced. Write errors on Tee are ignored.
+	Tee io.Writer
+	// RetainRecent, when positive, keeps the last RetainRecent lines sent in
+	// memory, for RecentLines to return, e.g. to see what the client actually
+	// sent from a debug endpoint without capturing packets. Lines are kept once
+	// they're written to the connection, so buffered or held lines only show up
+	// after they're flushed, and lines lost to a failed write never do.
+	RetainRecent int
+	// Rename, when set, is called with the name of every metric before the
+	// prefix is added, and the metric is sent with the name it returns, or
+	// skipped if it returns "". It's called with the client locked, so it
+	// must not use the client.
+	Rename func(name string) string
+	// ValidateMetrics drops the metrics that fail Metric.Validate, reporting
+	// an ErrInvalidMetric error to OnSendError, instead of sending lines that
+	// carbon would reject or turn into corrupt series
+	ValidateMetrics bool
+	// ClampNegativeTimestamps treats negative timestamps, usually the result
+	// of a bad conversion, as zero, so that the metrics are sent with the
+	// current time. Otherwise they are sent as they are, or dropped when
+	// ValidateMetrics is set.
+	ClampNegativeTimestamps bool
+	// DuplicateTimestampPolicy is what to do with batches that have more than
+	// one point for the same series and timestamp, which is usually a bug
+	DuplicateTimestampPolicy DuplicateTimestampPolicy
+	// MetricFilter, when set, is called with every metric, after Rename and
+	// before the prefix is added, and the metrics for which it returns false
+	// are dropped, e.g. to suppress debug metrics in production. It's called
+	// with the client locked, so it must not use the client.
+	MetricFilter func(Metric) bool
+	// DefaultTags are added to every metric sent, except for the tags the
+	// metric already has. The map must not be modified after the client is
+	// in use; see also WithInstanceTag.
+	DefaultTags map[string]string
+	// UnitSuffix makes SendTiming and SendBytes append the unit of their
+	// value, ".ms" or ".bytes", to the metric names, so that units are
+	// encoded in names consistently
+	UnitSuffix bool
+	// TagStyle selects how the tags of metrics are added to their names
+	TagStyle TagStyle
+	// FormatValue, when set, renders the values of metrics instead of the
+	// default formatting, which sends strings as they are and numbers in
+	// fixed-point notation
+	FormatValue func(interface{}) string
+	// CounterReset is the policy of SendRate and SendCounterDelta for
+	// counters that decrease
+	CounterReset CounterResetPolicy
+	// FailOnMalformed makes SendFromReader stop at the first malformed line
+	// instead of dropping it
+	FailOnMalformed bool
+	// Logger receives the log output, the standard logger is used when nil
+	Logger Logger
+	// Debug logs connections, reconnections and flushes; DisableLog only
+	// silences the nop mode output
+	Debug bool
+	// OnStateChange, when set, is called when the client switches between
+	// nop and live mode. It's called with the client locked, so it must not
+	// use the client.
+	OnStateChange func(ConnState)
+	stats         Stats
+	counters      map[string]int64
+	observations  map[string]observation
+	lastCounters  map[string]float64
+	recent        []string
+	recentNext    int
+	recentQueued  []string
+	prefixStack   []string
+	unflushed     int
+	broken        bool
+	held          bytes.Buffer
+	pending       *coalescedBatch
+	coalesceMu    sync.Mutex
+	firstSend     bool
+	clock         clock
+	lastErr       error
+	lastDial      time.Duration
+	connectedAt   time.Time
+	lastFlush     time.Time
+	rand          *rand.Rand
+	ctxLogger     Logger
+	reportedDrops uint64
+	done          chan struct{}
+	stopAutoFlush func()
+	dialed        bool
+	dialContext   func(ctx context.Context, network, address string) (net.Conn, error)
+	wg            sync.WaitGroup
+	mu            sync.Mutex
 }
 
+// ConnState is the mode of a Graphite client reported to OnStateChange
+type ConnState int
+
+const (
+	// StateNop means metrics are logged rather than sent
+	StateNop ConnState = iota
+	// StateConnected means metrics are sent to the Graphite host
+	StateConnected
+)
+
+func (state ConnState) String() string {
+	switch state {
+	case StateNop:
+		return "nop"
+	case StateConnected:
+		return "connected"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(state))
+}
+
+// TagStyle is the encoding of the tags of a metric in the line sent to carbon
+type TagStyle int
+
+const (
+	// TagStyleGraphite11 appends tags as ";tag=value", the tagged series
+	// format of Graphite 1.1
+	TagStyleGraphite11 TagStyle = iota
+	// TagStyleCarbonZipper appends tags as ".tag.value" path segments, with
+	// the dots in them replaced by underscores, for backends such as
+	// go-carbon and carbon-zipper setups that don't index tags
+	TagStyleCarbonZipper
+)
+
+// Logger is the interface used to log, it's implemented by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// loggerKey is the context key of the logger set by ContextWithLogger
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of ctx carrying logger. Sends given the
+// context, such as SendMetricsContext, log through it instead of the client
+// Logger, so that their diagnostics can be tied to e.g. a request.
+func ContextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// ErrLineTooLong is reported to OnSendError for metrics dropped because of
+// MaxLineLength
+var ErrLineTooLong = errors.New("graphite: line exceeds MaxLineLength")
+
+// defaultConnectRetryDelay is the wait before the first connection retry when
+// ConnectRetryDelay is not set
+const defaultConnectRetryDelay = 100 * time.Millisecond
+
+// ErrFiltered is reported to OnSendError for metrics dropped by MetricFilter
+var ErrFiltered = errors.New("graphite: metric rejected by MetricFilter")
+
+// ErrNotConnected is returned when sending on a client that is not in nop mode
+// and has no connection, because Connect was never called or failed, or after
+// Disconnect
+var ErrNotConnected = errors.New("graphite: not connected")
+
+// ErrEmptyHost and ErrInvalidPort are returned by the constructors given an
+// address that can't be dialed
+var (
+	ErrEmptyHost   = errors.New("graphite: host is empty")
+	ErrInvalidPort = errors.New("graphite: port is not between 1 and 65535")
+)
+
+// ErrTooManySegments is reported to OnSendError for metrics dropped because of
+// MaxNameSegments
+var ErrTooManySegments = errors.New("graphite: name exceeds MaxNameSegments")
+
 // defaultTimeout is the default number of seconds that we're willing to wait
 // before forcing the connection establishment to fail
 const defaultTimeout = 5
 
+// defaultBufferSize is the size of the write buffer when BufferSize is zero,
+// and minBufferSize the smallest allowed
+const (
+	defaultBufferSize = 4096
+	minBufferSize     = 512
+)
+
+// logf logs through the logger of the context of the current send, if any,
+// graphite.Logger or the standard logger
+func (graphite *Graphite) logf(format string, v ...interface{}) {
+	if graphite.ctxLogger != nil {
+		graphite.ctxLogger.Printf(format, v...)
+	} else if graphite.Logger != nil {
+		graphite.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// debugf logs only when graphite.Debug is set
+func (graphite *Graphite) debugf(format string, v ...interface{}) {
+	if graphite.Debug {
+		graphite.logf(format, v...)
+	}
+}
+
+// sampleNopLog reports whether a nop mode metric is logged according to
+// NopLogSampleRate, the caller must hold graphite.mu
+func (graphite *Graphite) sampleNopLog() bool {
+	if graphite.NopLogSampleRate <= 0 || graphite.NopLogSampleRate >= 1 {
+		return true
+	}
+	if graphite.rand == nil {
+		return rand.Float64() < graphite.NopLogSampleRate
+	}
+	return graphite.rand.Float64() < graphite.NopLogSampleRate
+}
+
 // IsNop is a getter for *graphite.Graphite.nop
 func (graphite *Graphite) IsNop() bool {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
 	if graphite.nop {
 		return true
 	}
 	return false
 }
 
+// IsConnected reports whether the client is in live mode with a connection,
+// and its last connection or send attempt succeeded
+func (graphite *Graphite) IsConnected() bool {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return !graphite.nop && graphite.writer != nil && graphite.lastErr == nil
+}
+
 // Given a Graphite struct, Connect populates the Graphite.conn field with an
-// appropriate TCP connection
+// appropriate TCP connection. It retries a failed dial ConnectRetries times,
+// releasing the client between attempts, so that other goroutines aren't
+// blocked while it waits. Buffered metrics are flushed to the old connection
+// first, on a best-effort basis.
 func (graphite *Graphite) Connect() error {
-	if !graphite.IsNop() {
+	graphite.mu.Lock()
+	err := graphite.connect(context.Background())
+	retries, delay := graphite.ConnectRetries, graphite.ConnectRetryDelay
+	graphite.mu.Unlock()
+
+	if delay == 0 {
+		delay = defaultConnectRetryDelay
+	}
+	for retry := 0; err != nil && retry < retries; retry++ {
+		graphite.mu.Lock()
+		graphite.debugf("Graphite: can't connect to %s:%d, retrying in %v: %v", graphite.Host, graphite.Port, delay, err)
+		graphite.mu.Unlock()
+		time.Sleep(delay)
+		delay *= 2
+
+		graphite.mu.Lock()
+		err = graphite.connect(context.Background())
+		graphite.mu.Unlock()
+	}
+	return err
+}
+
+// connect is the lock-free implementation of Connect, making a single attempt
+// so that reconnecting from a send doesn't hold the client during a backoff,
+// the caller must hold graphite.mu
+func (graphite *Graphite) connect(ctx context.Context) error {
+	err := graphite.dial(ctx)
+	graphite.lastErr = err
+	if err == nil && !graphite.nop {
+		if graphite.dialed {
+			graphite.stats.Reconnects++
+		}
+		graphite.dialed = true
+	}
+	return err
+}
+
+// bufferSize returns BufferSize, or its default, clamped to minBufferSize
+func (graphite *Graphite) bufferSize() int {
+	if graphite.BufferSize == 0 {
+		return defaultBufferSize
+	}
+	if graphite.BufferSize < minBufferSize {
+		return minBufferSize
+	}
+	return graphite.BufferSize
+}
+
+// dial opens the connection and binds the buffered writer to it, giving up
+// when ctx is done
+func (graphite *Graphite) dial(ctx context.Context) error {
+	if graphite.writer != nil && !graphite.broken {
+		// don't lose the metrics held back by MinFlushInterval or
+		// AutoFlushInterval, on a best-effort basis like rotate
+		if err := graphite.flush(); err != nil {
+			graphite.debugf("Graphite: flushing before reconnecting to %s:%d: %v", graphite.Host, graphite.Port, err)
+		}
+	}
+	if graphite.sink != nil {
+		graphite.writer = bufio.NewWriterSize(graphite.sink, graphite.bufferSize())
+		graphite.unflushed = 0
+		graphite.broken = false
+		return nil
+	}
+
+	if !graphite.nop {
 		if graphite.conn != nil {
 			graphite.conn.Close()
 		}
 
-		address := fmt.Sprintf("%s:%d", graphite.Host, graphite.Port)
+		address := net.JoinHostPort(graphite.Host, strconv.Itoa(graphite.Port))
 
 		if graphite.Timeout == 0 {
 			graphite.Timeout = defaultTimeout * time.Second
@@ -50,97 +483,700 @@ func (graphite *Graphite) Connect() error {
 		var err error
 		var conn net.Conn
 
-		if graphite.Protocol == "udp" {
-			udpAddr, err := net.ResolveUDPAddr("udp", address)
-			if err != nil {
-				return err
-			}
-			conn, err = net.DialUDP(graphite.Protocol, nil, udpAddr)
-		} else {
-			conn, err = net.DialTimeout(graphite.Protocol, address, graphite.Timeout)
-		}
+		start := graphite.now()
+		defer func() { graphite.lastDial = graphite.now().Sub(start) }()
+		conn, err = graphite.dialer()(ctx, graphite.Protocol, address)
 
 		if err != nil {
 			return err
 		}
+		if err = graphite.configureConn(conn); err != nil {
+			conn.Close()
+			return err
+		}
 
+		graphite.debugf("Graphite: connected to %s://%s", graphite.Protocol, address)
 		graphite.conn = conn
+		graphite.connectedAt = start
+		graphite.writer = bufio.NewWriterSize(conn, graphite.bufferSize())
+		graphite.unflushed = 0
+		graphite.broken = false
+		graphite.firstSend = graphite.Protocol != "udp"
 	}
 
 	return nil
 }
 
-// Given a Graphite struct, Disconnect closes the Graphite.conn field
+// dialer returns the function used to open connections, which tests replace
+func (graphite *Graphite) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	if graphite.dialContext != nil {
+		return graphite.dialContext
+	}
+	return (&net.Dialer{Timeout: graphite.Timeout}).DialContext
+}
+
+// configureConn applies the socket options to a freshly dialed connection
+func (graphite *Graphite) configureConn(conn net.Conn) error {
+	if graphite.NoDelay {
+		if tcpConn, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+			if err := tcpConn.SetNoDelay(true); err != nil {
+				return err
+			}
+		}
+	}
+	if graphite.Linger != nil {
+		if tcpConn, ok := conn.(interface{ SetLinger(int) error }); ok {
+			if err := tcpConn.SetLinger(*graphite.Linger); err != nil {
+				return err
+			}
+		}
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		if graphite.UDPSendBuffer > 0 {
+			if err := udpConn.SetWriteBuffer(graphite.UDPSendBuffer); err != nil {
+				return err
+			}
+		}
+		if graphite.UDPReceiveBuffer > 0 {
+			if err := udpConn.SetReadBuffer(graphite.UDPReceiveBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Given a Graphite struct, Disconnect flushes any buffered metrics and closes
+// the Graphite.conn field, returning the errors of both
 func (graphite *Graphite) Disconnect() error {
-	err := graphite.conn.Close()
-	graphite.conn = nil
+	graphite.mu.Lock()
+	stopAutoFlush := graphite.takeAutoFlusher()
+	err := graphite.disconnect()
+	graphite.mu.Unlock()
+
+	stopAutoFlush()
 	return err
 }
 
+// Close stops the background goroutines of the client and disconnects it.
+// It's CloseContext with a deadline of Timeout (5 seconds if zero), so that
+// a peer that stopped reading can't block it forever.
+func (graphite *Graphite) Close() error {
+	graphite.mu.Lock()
+	timeout := graphite.Timeout
+	graphite.mu.Unlock()
+	if timeout == 0 {
+		timeout = defaultTimeout * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return graphite.CloseContext(ctx)
+}
+
+// CloseContext is like Close, but gives up writing the buffered metrics of a
+// network client when ctx is done: the connection is closed anyway and the
+// error, wrapping ctx.Err(), tells how many metrics were dropped
+func (graphite *Graphite) CloseContext(ctx context.Context) error {
+	graphite.mu.Lock()
+	if graphite.done != nil {
+		close(graphite.done)
+		graphite.done = nil
+	}
+	graphite.mu.Unlock()
+	graphite.wg.Wait()
+
+	graphite.mu.Lock()
+	stopAutoFlush := graphite.takeAutoFlusher()
+	// deferred first, so it runs after unlocking
+	defer stopAutoFlush()
+	defer graphite.mu.Unlock()
+
+	if conn := graphite.conn; conn != nil {
+		// unblock the final flush when ctx is done
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.SetWriteDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+	}
+	pending := graphite.unflushed
+	err := graphite.disconnect()
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return fmt.Errorf("graphite: closed before flushing, dropped %d metrics: %w", pending, ctxErr)
+	}
+	return err
+}
+
+// setState reports a state change to OnStateChange, the caller must hold
+// graphite.mu
+func (graphite *Graphite) setState(state ConnState) {
+	if graphite.OnStateChange != nil {
+		graphite.OnStateChange(state)
+	}
+}
+
+// retryConnect tries to connect every interval while the client is in nop mode
+// after falling back to it, and switches the client to live mode as soon as
+// it succeeds. It stops when the client is closed.
+func (graphite *Graphite) retryConnect(interval time.Duration) {
+	done := make(chan struct{})
+	graphite.done = done
+	graphite.wg.Add(1)
+
+	go func() {
+		defer graphite.wg.Done()
+		ticker := graphite.newTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+			}
+
+			graphite.mu.Lock()
+			select {
+			case <-done:
+				graphite.mu.Unlock()
+				return
+			default:
+			}
+			graphite.nop = false
+			if err := graphite.connect(context.Background()); err != nil {
+				graphite.nop = true
+				graphite.mu.Unlock()
+				continue
+			}
+			graphite.logf("Graphite: connected to %s:%d, leaving nop mode", graphite.Host, graphite.Port)
+			graphite.setState(StateConnected)
+			graphite.mu.Unlock()
+			return
+		}
+	}()
+}
+
+// Reset closes the connection, if any, and connects again using the current
+// settings, e.g. after changing Timeout at runtime or to rotate connections
+// behind a load balancer. Buffered metrics are flushed to the old connection
+// first, on a best-effort basis. Sends from other goroutines wait for it and
+// then go to the new connection.
+func (graphite *Graphite) Reset() error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.rotate(context.Background())
+}
+
+// rotate is the lock-free implementation of Reset, the caller must hold
+// graphite.mu
+func (graphite *Graphite) rotate(ctx context.Context) error {
+	if err := graphite.disconnect(); err != nil {
+		graphite.debugf("Graphite: closing the connection to %s:%d: %v", graphite.Host, graphite.Port, err)
+	}
+	if err := graphite.connect(ctx); err != nil {
+		// the old connection is gone: make the next send dial again
+		graphite.broken = true
+		return err
+	}
+	return nil
+}
+
+// disconnect is the lock-free implementation of Disconnect, the caller must
+// hold graphite.mu
+func (graphite *Graphite) disconnect() error {
+	// with ManualFlush or MinFlushInterval this may be the only write of
+	// the metrics held back, so its failure must be reported
+	flushErr := graphite.flush()
+	var closeErr error
+	if graphite.conn != nil {
+		closeErr = graphite.conn.Close()
+	}
+	graphite.conn = nil
+	graphite.writer = nil
+	return errors.Join(flushErr, closeErr)
+}
+
+// LastDialDuration returns how long the most recent connection attempt took,
+// including name resolution, whether or not it succeeded. It helps telling
+// slow DNS or connects apart from slow sends.
+func (graphite *Graphite) LastDialDuration() time.Duration {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.lastDial
+}
+
+// LastError returns the error of the most recent connection or send attempt,
+// or nil if it succeeded. It's a simple health signal, e.g. for a /healthz
+// handler.
+func (graphite *Graphite) LastError() error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.lastErr
+}
+
+// Flush writes any buffered metrics to the Graphite connection
+func (graphite *Graphite) Flush() error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.flush()
+}
+
+// flush is the lock-free implementation of Flush, the caller must hold
+// graphite.mu
+func (graphite *Graphite) flush() error {
+	if graphite.writer == nil {
+		return nil
+	}
+	if graphite.Debug && graphite.writer.Buffered() > 0 {
+		graphite.debugf("Graphite: flushing %d bytes", graphite.writer.Buffered())
+	}
+	if graphite.held.Len() > 0 {
+		// write errors are sticky and returned by Flush below
+		graphite.writer.Write(graphite.held.Bytes())
+		graphite.held.Reset()
+	}
+	if graphite.ReportFlushCount && graphite.unflushed > 0 {
+		// not counted in unflushed, so it doesn't count itself
+		graphite.writeReport(NewMetricInt("graphite.flush.count", int64(graphite.unflushed), graphite.timestampNow().Unix()))
+	}
+	if dropped := graphite.stats.MetricsDropped - graphite.reportedDrops; graphite.ReportDropped && dropped > 0 {
+		// written directly, so it can't be dropped itself
+		graphite.writeReport(NewMetricInt("graphite.dropped", int64(dropped), graphite.timestampNow().Unix()))
+		graphite.reportedDrops = graphite.stats.MetricsDropped
+	}
+	buffered := graphite.writer.Buffered()
+	if err := graphite.writer.Flush(); err != nil {
+		// the peer likely closed the connection partway through the batch:
+		// discard the rest, so the next batch doesn't start with a partial
+		// line, and reconnect before the next send
+		written := buffered - graphite.writer.Buffered()
+		graphite.writer.Reset(graphite.writerTarget())
+		graphite.unflushed = 0
+		graphite.recentQueued = graphite.recentQueued[:0]
+		graphite.broken = true
+		return fmt.Errorf("graphite: connection failed after writing %d of %d buffered bytes, discarded the rest: %w", written, buffered, err)
+	}
+	if graphite.MinFlushInterval > 0 {
+		graphite.lastFlush = graphite.now()
+	}
+	if graphite.unflushed > 0 {
+		graphite.stats.recordFlush(graphite.unflushed)
+		graphite.unflushed = 0
+	}
+	graphite.retainQueued()
+	return nil
+}
+
+// writeReport writes a metric generated by the client itself to the buffer,
+// copying it to Tee and RetainRecent like the metrics sent
+func (graphite *Graphite) writeReport(metric Metric) {
+	metric.Timestamp = graphite.offsetTimestamp(metric.Timestamp)
+	line := graphite.formatMetric(metricPrefix(graphite.effectivePrefix()), metric)
+	if graphite.Tee != nil {
+		io.WriteString(graphite.Tee, frameLine(line))
+	}
+	graphite.writer.WriteString(frameLine(line))
+	graphite.queueRecent(line)
+}
+
+// writerTarget returns the destination of the buffered writer
+func (graphite *Graphite) writerTarget() io.Writer {
+	if graphite.sink != nil {
+		return graphite.sink
+	}
+	return graphite.conn
+}
+
 // Given a Metric struct, the SendMetric method sends the supplied metric to the
 // Graphite connection that the method is called upon
 func (graphite *Graphite) SendMetric(metric Metric) error {
+	if graphite.CoalesceWindow > 0 {
+		return graphite.sendCoalesced(metric)
+	}
+
 	metrics := make([]Metric, 1)
 	metrics[0] = metric
 
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
 	return graphite.sendMetrics(metrics)
 }
 
+// SendMetricOK is like SendMetric, but also reports whether the metric was
+// actually sent, rather than skipped because it has no name or dropped by a
+// check such as MaxLineLength
+func (graphite *Graphite) SendMetricOK(metric Metric) (bool, error) {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	sent, err := graphite.sendMetricsContext(context.Background(), []Metric{metric})
+	return sent == 1, err
+}
+
 // Given a slice of Metrics, the SendMetrics method sends the metrics, as a
 // batch, to the Graphite connection that the method is called upon
 func (graphite *Graphite) SendMetrics(metrics []Metric) error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
 	return graphite.sendMetrics(metrics)
 }
 
+// SendMetricsAndFlush sends the metrics like SendMetrics does and then flushes
+// the connection buffer before returning. SendMetrics only promises that the
+// metrics were handed to the client and they may still sit in the buffer when
+// it returns; a nil error from SendMetricsAndFlush means the whole batch was
+// accepted by the socket. Use it in short-lived programs that exit right after
+// sending.
+func (graphite *Graphite) SendMetricsAndFlush(metrics []Metric) error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	if err := graphite.sendMetrics(metrics); err != nil {
+		return err
+	}
+	return graphite.flush()
+}
+
+// SendMetricsContext is like SendMetrics, but stops sending when ctx is done
+// and returns ctx.Err(). The metrics already written to the buffer are flushed
+// on a best-effort basis, so that they don't linger and get sent along with a
+// later, unrelated batch.
+func (graphite *Graphite) SendMetricsContext(ctx context.Context, metrics []Metric) error {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	_, err := graphite.sendMetricsContext(ctx, metrics)
+	return err
+}
+
+// SendMetricsTimed is like SendMetrics and also returns how long writing and
+// flushing the metrics took, a rough measure of how fast carbon is accepting
+// data. The time spent waiting for other senders isn't included.
+func (graphite *Graphite) SendMetricsTimed(metrics []Metric) (time.Duration, error) {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	start := graphite.now()
+	err := graphite.sendMetrics(metrics)
+	if err == nil {
+		err = graphite.flush()
+	}
+	return graphite.now().Sub(start), err
+}
+
 // sendMetrics is an internal function that is used to write to the TCP
-// connection in order to communicate metrics to the remote Graphite host
+// connection in order to communicate metrics to the remote Graphite host, the
+// caller must hold graphite.mu
 func (graphite *Graphite) sendMetrics(metrics []Metric) error {
-	if graphite.IsNop() {
-		if !graphite.DisableLog {
-			for _, metric := range metrics {
-				log.Printf("Graphite: %s\n", metric)
+	_, err := graphite.sendMetricsContext(context.Background(), metrics)
+	return err
+}
+
+// sendMetricsContext is the implementation of sendMetrics, checking ctx
+// before writing each metric; it returns the number of metrics written
+func (graphite *Graphite) sendMetricsContext(ctx context.Context, metrics []Metric) (int, error) {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		graphite.ctxLogger = logger
+		defer func() { graphite.ctxLogger = nil }()
+	}
+	prepared, err := graphite.prepareMetrics(metrics)
+	if err == nil && len(prepared) == 0 {
+		// nothing left to send, e.g. all the metrics were unnamed or
+		// filtered: don't probe, reconnect or flush the connection, and
+		// leave LastError alone
+		return 0, nil
+	}
+	if graphite.AutoFlushInterval > 0 && graphite.stopAutoFlush == nil && !graphite.nop && graphite.writer != nil && graphite.Protocol != "udp" {
+		graphite.stopAutoFlush = graphite.startAutoFlush(graphite.AutoFlushInterval)
+	}
+	opCtx := ctx
+	if graphite.OpTimeout > 0 {
+		var cancel context.CancelFunc
+		opCtx, cancel = context.WithTimeout(ctx, graphite.OpTimeout)
+		defer cancel()
+	}
+	// an expired OpTimeout is a send error, unlike a done ctx
+	sent := 0
+	if err == nil {
+		sent, err = graphite.writeMetrics(opCtx, prepared)
+	}
+	graphite.stats.MetricsSent += uint64(sent)
+	if err == nil || err != ctx.Err() {
+		graphite.lastErr = err
+		if err != nil {
+			graphite.stats.SendErrors++
+		}
+	}
+	return sent, err
+}
+
+// preparedMetric is a metric that passed all the checks, with its line
+type preparedMetric struct {
+	metric Metric
+	line   string
+}
+
+// prepareMetrics applies DuplicateTimestampPolicy and prepareMetric to metrics
+// and returns the ones left to send
+func (graphite *Graphite) prepareMetrics(metrics []Metric) ([]preparedMetric, error) {
+	metrics, err := graphite.applyDuplicatePolicy(metrics)
+	if err != nil {
+		return nil, err
+	}
+	var batchTimestamp int64
+	if graphite.UseBatchTimestamp {
+		batchTimestamp = graphite.timestampNow().Unix()
+	}
+	prefix := metricPrefix(graphite.effectivePrefix())
+	prepared := make([]preparedMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		metric, line, ok := graphite.prepareMetric(prefix, metric, batchTimestamp)
+		if ok {
+			prepared = append(prepared, preparedMetric{metric, line})
+		}
+	}
+	return prepared, nil
+}
+
+// writeMetrics writes the prepared metrics to the connection
+func (graphite *Graphite) writeMetrics(ctx context.Context, metrics []preparedMetric) (int, error) {
+	if graphite.nop {
+		// the metrics went through the same checks as a live send, so
+		// that the counts match
+		for _, metric := range metrics {
+			if !graphite.DisableLog && graphite.sampleNopLog() {
+				graphite.logf("Graphite: %s\n", metric.metric)
 			}
 		}
-		return nil
+		return len(metrics), nil
+	}
+	if graphite.broken {
+		graphite.debugf("Graphite: reconnecting to %s:%d after a failed flush", graphite.Host, graphite.Port)
+		if err := graphite.connect(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if graphite.MaxConnectionAge > 0 && graphite.conn != nil && graphite.now().Sub(graphite.connectedAt) >= graphite.MaxConnectionAge {
+		graphite.debugf("Graphite: connection to %s:%d is older than %v, reconnecting", graphite.Host, graphite.Port, graphite.MaxConnectionAge)
+		if err := graphite.rotate(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if graphite.CheckConnBeforeSend && graphite.conn != nil && graphite.Protocol != "udp" && !connIsAlive(graphite.conn) {
+		graphite.debugf("Graphite: connection to %s:%d is stale, reconnecting", graphite.Host, graphite.Port)
+		if err := graphite.connect(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if graphite.Protocol == "udp" && graphite.conn == nil || graphite.Protocol != "udp" && graphite.writer == nil {
+		return 0, ErrNotConnected
 	}
-	zeroed_metric := Metric{} // ignore unintialized metrics
-	buf := bufio.NewWriter(graphite.conn)
-	prefix := ""
-	if graphite.Prefix != "" {
-		prefix = graphite.Prefix + "."
+	if graphite.firstSend && graphite.conn != nil {
+		// the dial timeout doesn't protect the first send from a server
+		// that accepts connections but never reads, so bound it as well
+		conn := graphite.conn
+		conn.SetWriteDeadline(time.Now().Add(graphite.Timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+		graphite.firstSend = false
+	}
+	sent := 0
+	buf := graphite.writer
+	var packer *datagramPacker
+	if graphite.Protocol == "udp" {
+		packer = graphite.newDatagramPacker(ctx)
 	}
 	for _, metric := range metrics {
-		if metric == zeroed_metric {
-			continue // ignore unintialized metrics
+		if err := ctx.Err(); err != nil {
+			if packer != nil {
+				packer.flush()
+				return packer.sent, err
+			}
+			if !graphite.ManualFlush {
+				graphite.flush()
+			}
+			return sent, err
 		}
-		if metric.Timestamp == 0 {
-			metric.Timestamp = time.Now().Unix()
+		line := metric.line
+		if graphite.Tee != nil {
+			io.WriteString(graphite.Tee, frameLine(line))
+		}
+		if packer != nil {
+			if err := packer.add(line); err != nil {
+				return packer.sent, err
+			}
+			continue
 		}
-		if graphite.Protocol == "udp" {
-			fmt.Fprintf(graphite.conn, "%s%s %v %d\n", prefix, metric.Name, metric.Value, metric.Timestamp)
+		if graphite.ManualFlush {
+			graphite.held.WriteString(frameLine(line))
+			graphite.queueRecent(line)
+			graphite.unflushed++
+			sent++
 			continue
 		}
-		if buf.Available() < 512 {
-			if err := buf.Flush(); err != nil {
-				return err
+		framed := frameLine(line)
+		if buf.Buffered() > 0 && buf.Available() < len(framed) {
+			// flush before the line rather than splitting it between writes
+			if err := graphite.flush(); err != nil {
+				return sent, err
+			}
+		}
+		buf.WriteString(framed)
+		graphite.queueRecent(line)
+		graphite.unflushed++
+		sent++
+		if graphite.FlushBytesThreshold > 0 && buf.Buffered() >= graphite.FlushBytesThreshold {
+			if err := graphite.flush(); err != nil {
+				return sent, err
 			}
 		}
-		fmt.Fprintf(graphite.conn, "%s%s %v %d\n", prefix, metric.Name, metric.Value, metric.Timestamp)
 	}
-	if graphite.Protocol == "tcp" {
-		err := buf.Flush()
-		if err != nil {
-			return err
+	if packer != nil {
+		err := packer.flush()
+		if err == nil && len(packer.oversized) > 0 {
+			if err = graphite.sendOversized(ctx, packer.oversized); err == nil {
+				packer.sent += len(packer.oversized)
+				packer.retainLines(packer.oversized)
+			}
 		}
+		return packer.sent, err
+	}
+	if graphite.ManualFlush {
+		return sent, nil
+	}
+	if graphite.MinFlushInterval > 0 && graphite.now().Sub(graphite.lastFlush) < graphite.MinFlushInterval {
+		return sent, nil
+	}
+	err := graphite.flush()
+	if err != nil {
+		return sent, err
+	}
+	return sent, nil
+}
+
+// prepareMetric applies Rename, MetricFilter, DefaultTags and the timestamp
+// defaults to metric and formats its line, with prefix unless the metric has
+// NoPrefix; it returns false for the metrics that are skipped or dropped by a
+// check. The caller must hold graphite.mu.
+func (graphite *Graphite) prepareMetric(prefix string, metric Metric, batchTimestamp int64) (Metric, string, bool) {
+	if metric.Name == "" {
+		return metric, "", false // ignore unintialized and unnamed metrics
+	}
+	if metric.Name = graphite.rename(metric.Name); metric.Name == "" {
+		return metric, "", false
+	}
+	if graphite.MetricFilter != nil && !graphite.MetricFilter(metric) {
+		graphite.dropMetric(fmt.Errorf("%w: %s", ErrFiltered, metric.Name))
+		return metric, "", false
+	}
+	metric = graphite.addDefaultTags(metric)
+	if metric.Timestamp < 0 && graphite.ClampNegativeTimestamps {
+		metric.Timestamp = 0
+	}
+	if metric.Timestamp == 0 {
+		metric.Timestamp = batchTimestamp
+		if metric.Timestamp == 0 {
+			metric.Timestamp = graphite.timestampNow().Unix()
+		}
+	}
+	metric.Timestamp = graphite.offsetTimestamp(metric.Timestamp)
+	if graphite.ValidateMetrics {
+		if err := metric.Validate(); err != nil {
+			graphite.dropMetric(err)
+			return metric, "", false
+		}
+	}
+	namePrefix := prefix
+	if metric.NoPrefix {
+		namePrefix = ""
+	}
+	if graphite.MaxNameSegments > 0 {
+		if segments := strings.Count(namePrefix+metric.Name, ".") + 1; segments > graphite.MaxNameSegments {
+			graphite.dropMetric(fmt.Errorf("%w: %d segments in %s%s", ErrTooManySegments, segments, namePrefix, metric.Name))
+			return metric, "", false
+		}
+	}
+	line := graphite.formatMetric(namePrefix, metric)
+	if graphite.MaxLineLength > 0 && len(line) > graphite.MaxLineLength {
+		graphite.dropMetric(fmt.Errorf("%w: %d bytes for %s", ErrLineTooLong, len(line), metric.Name))
+		return metric, "", false
+	}
+	return metric, line, true
+}
+
+// rename applies the Rename hook, if any, to name
+func (graphite *Graphite) rename(name string) string {
+	if graphite.Rename == nil || name == "" {
+		return name
+	}
+	return graphite.Rename(name)
+}
+
+// metricPrefix returns the string to prepend to metric names for prefix, which
+// ends with exactly one dot whether or not prefix already has one
+func metricPrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, ".")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "."
+}
+
+// lineTerminator ends each line of the carbon plaintext protocol
+const lineTerminator = "\n"
+
+// frameLine terminates a line formatted by formatMetric for the plaintext
+// protocol. It's the only place adding the terminator: encoders that frame
+// lines by length must use the bare line instead.
+func frameLine(line string) string {
+	return line + lineTerminator
+}
+
+// formatMetric renders metric as a carbon plaintext line, without the line
+// terminator
+func (graphite *Graphite) formatMetric(prefix string, metric Metric) string {
+	format := formatValue
+	if graphite.FormatValue != nil {
+		format = graphite.FormatValue
+	}
+	tags := metric.tagString()
+	if graphite.TagStyle == TagStyleCarbonZipper {
+		tags = metric.pathTagString()
+	}
+	if graphite.SendInterval && metric.Interval > 0 {
+		return fmt.Sprintf("%s%s%s %s %d %d", prefix, metric.Name, tags, format(metric.Value), metric.Timestamp, metric.Interval)
+	}
+	return fmt.Sprintf("%s%s%s %s %d", prefix, metric.Name, tags, format(metric.Value), metric.Timestamp)
+}
+
+// dropMetric counts a metric that was not sent and reports the reason to
+// OnSendError, the caller must hold graphite.mu
+func (graphite *Graphite) dropMetric(err error) {
+	graphite.stats.MetricsDropped++
+	if graphite.OnSendError != nil {
+		graphite.OnSendError(err)
 	}
-	return nil
 }
 
 // The SimpleSend method can be used to just pass a metric name and value and
 // have it be sent to the Graphite host with the current timestamp
 func (graphite *Graphite) SimpleSend(stat string, value string) error {
 	metrics := make([]Metric, 1)
-	metrics[0] = NewMetric(stat, value, time.Now().Unix())
+	metrics[0] = NewMetric(stat, value, graphite.timestampNow().Unix())
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
 	err := graphite.sendMetrics(metrics)
 	if err != nil {
 		return err
@@ -148,6 +1184,129 @@ func (graphite *Graphite) SimpleSend(stat string, value string) error {
 	return nil
 }
 
+// SimpleSendf is like SimpleSend, with the metric name built from format and
+// args like fmt.Sprintf does, e.g. SimpleSendf("api.%s.requests", "1", route).
+// The resulting name goes through the same checks as any other.
+func (graphite *Graphite) SimpleSendf(format string, value string, args ...interface{}) error {
+	return graphite.SimpleSend(fmt.Sprintf(format, args...), value)
+}
+
+// SimpleSendMany works like SimpleSend for alternating name and value
+// arguments, sending all the metrics as one batch with the same timestamp
+func (graphite *Graphite) SimpleSendMany(pairs ...string) error {
+	if len(pairs)%2 != 0 {
+		return fmt.Errorf("graphite: SimpleSendMany got %d arguments, expected name/value pairs", len(pairs))
+	}
+	timestamp := graphite.timestampNow().Unix()
+	metrics := make([]Metric, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		metrics = append(metrics, NewMetric(pairs[i], pairs[i+1], timestamp))
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
+
+// SendWithRollup sends the metric name together with a copy under each of the
+// rollups, as one batch with the current timestamp, e.g. to feed both the raw
+// series and a carbon-aggregator rule. A rollup ending with a dot is a prefix
+// prepended to name, any other rollup is a full metric name. Each distinct
+// name is sent once.
+func (graphite *Graphite) SendWithRollup(name, value string, rollups ...string) error {
+	timestamp := graphite.timestampNow().Unix()
+	seen := map[string]bool{name: true}
+	metrics := []Metric{NewMetric(name, value, timestamp)}
+	for _, rollup := range rollups {
+		if strings.HasSuffix(rollup, ".") {
+			rollup += name
+		}
+		if seen[rollup] {
+			continue
+		}
+		seen[rollup] = true
+		metrics = append(metrics, NewMetric(rollup, value, timestamp))
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
+
+// SendMetricMap sends a set of gauges, keyed by name, as one batch with the
+// current timestamp
+func (graphite *Graphite) SendMetricMap(values map[string]float64) error {
+	return graphite.SendMetricMapAt(values, time.Time{})
+}
+
+// SendMetricMapAt sends a set of gauges, keyed by name, as one batch with the
+// timestamp t, or the current time if t is zero. This is useful to backfill
+// values. Metrics are sent sorted by name.
+func (graphite *Graphite) SendMetricMapAt(values map[string]float64, t time.Time) error {
+	if t.IsZero() {
+		t = graphite.timestampNow()
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]Metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, NewMetricFloat(name, values[name], t.Unix()))
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
+
+// TestConnection checks that a Graphite host is reachable by dialing it and
+// closing the connection right away, without creating a Graphite client. It's
+// meant for startup healthchecks. UDP is connectionless, so for "udp" it sends
+// an empty datagram and can only detect resolution and local errors.
+func TestConnection(protocol string, host string, port int, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = defaultTimeout * time.Second
+	}
+	conn, err := net.DialTimeout(protocol, net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	if protocol == "udp" {
+		if _, err := conn.Write(nil); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return conn.Close()
+}
+
+// SendTimeSeries sends the points of the series called name as one batch,
+// sorted by timestamp so that whisper receives them in order. It's meant for
+// backfills; points with a zero timestamp get the current time.
+func (graphite *Graphite) SendTimeSeries(name string, points []Point) error {
+	sorted := make([]Point, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	metrics := make([]Metric, len(sorted))
+	for i, point := range sorted {
+		metrics[i] = NewMetric(name, point.Value, point.Timestamp)
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
+
 // NewGraphite is a factory method that's used to create a new Graphite
 func NewGraphite(host string, port int) (*Graphite, error) {
 	return GraphiteFactory("tcp", host, port, "")
@@ -167,21 +1326,45 @@ func NewGraphiteUDP(host string, port int) (*Graphite, error) {
 // not actually try to send any packets to a remote host and, instead, will just
 // log. This is useful if you want to use Graphite in a project but don't want
 // to make Graphite a requirement for the project.
+//
+// Since it can't return an error, it's the only constructor that doesn't
+// validate host and port, which a nop client never uses, so that it can stand
+// in for a client that isn't configured; use GraphiteFactory with "nop" to
+// have them validated.
 func NewGraphiteNop(host string, port int) *Graphite {
-	graphiteNop, _ := GraphiteFactory("nop", host, port, "")
+	graphiteNop := &Graphite{Host: host, Port: port, nop: true}
+	graphiteNop.Connect()
 	return graphiteNop
 }
 
+// NewGraphiteWriter is a factory method that returns a Graphite struct writing
+// metrics to w, in the same format used on the wire, rather than to a remote
+// host. This is useful to send metrics to a file or a pipe, or to check what
+// would be sent in tests.
+func NewGraphiteWriter(w io.Writer, prefix string) *Graphite {
+	graphite := &Graphite{Prefix: prefix, sink: w}
+	graphite.Connect()
+	return graphite
+}
+
+// GraphiteFactory is a factory method that's used to create a new Graphite
+// using protocol, one of "tcp", "udp" or "nop". It returns an error, without
+// connecting, when host is empty or port is not between 1 and 65535, for nop
+// as well, so that config mistakes surface even while Graphite is disabled.
 func GraphiteFactory(protocol string, host string, port int, prefix string) (*Graphite, error) {
+	if err := validateAddress(host, port); err != nil {
+		return nil, err
+	}
+
 	var graphite *Graphite
 
 	switch protocol {
-	case "tcp":
-		graphite = &Graphite{Host: host, Port: port, Protocol: "tcp", Prefix: prefix}
-	case "udp":
-		graphite = &Graphite{Host: host, Port: port, Protocol: "udp", Prefix: prefix}
+	case "tcp", "udp":
+		graphite = &Graphite{Host: host, Port: port, Protocol: protocol, Prefix: prefix}
 	case "nop":
 		graphite = &Graphite{Host: host, Port: port, nop: true}
+	default:
+		return nil, fmt.Errorf("graphite: unsupported protocol %q", protocol)
 	}
 
 	err := graphite.Connect()
@@ -191,3 +1374,14 @@ func GraphiteFactory(protocol string, host string, port int, prefix string) (*Gr
 
 	return graphite, nil
 }
+
+// validateAddress checks that host and port can be dialed
+func validateAddress(host string, port int) error {
+	if host == "" {
+		return ErrEmptyHost
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("%w: %d", ErrInvalidPort, port)
+	}
+	return nil
+}
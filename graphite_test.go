@@ -1,10 +1,19 @@
 package graphite
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const TCP = "tcp"
@@ -15,6 +24,91 @@ const NOP = "nop"
 var graphiteHost = "carbon.hostedgraphite.com"
 var graphitePort = 2003
 
+// testServer is a loopback TCP listener that records everything written to it
+type testServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	data     bytes.Buffer
+	conns    []net.Conn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return srv
+}
+
+func (srv *testServer) serve(conn net.Conn) {
+	srv.mu.Lock()
+	srv.conns = append(srv.conns, conn)
+	srv.mu.Unlock()
+
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		srv.mu.Lock()
+		srv.data.Write(buf[:n])
+		srv.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (srv *testServer) Port() int {
+	return srv.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (srv *testServer) Data() string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.data.String()
+}
+
+// dropConnections closes the server side of all the accepted connections
+func (srv *testServer) dropConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+// waitForData polls the server until it received expected or a second elapsed
+func (srv *testServer) waitForData(t *testing.T, expected string) {
+	deadline := time.Now().Add(time.Second)
+	for srv.Data() != expected && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if data := srv.Data(); data != expected {
+		t.Errorf("Server received %q, expected %q", data, expected)
+	}
+}
+
+func newTestGraphite(t *testing.T, srv *testServer) *Graphite {
+	gr, err := GraphiteFactory(TCP, "127.0.0.1", srv.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gr.Disconnect() })
+	return gr
+}
+
 func TestNewGraphite(t *testing.T) {
 	gh, err := NewGraphite(graphiteHost, graphitePort)
 	if err != nil {
@@ -104,6 +198,1584 @@ func TestGraphiteFactoryNop(t *testing.T) {
 	}
 }
 
+func TestSendMetricsAndFlush(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+
+	err := gr.SendMetricsAndFlush([]Metric{
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("bar", "2", 1500000001),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if gr.writer.Buffered() != 0 {
+		t.Errorf("%d bytes left in the buffer", gr.writer.Buffered())
+	}
+
+	srv.waitForData(t, "foo 1 1500000000\nbar 2 1500000001\n")
+}
+
+func TestCheckConnBeforeSend(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.CheckConnBeforeSend = true
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the connection to be accepted, then half-close it from the
+	// server side, as an OS or a proxy dropping an idle connection would
+	srv.waitForData(t, "foo 1 1500000000\n")
+	srv.dropConnections()
+	time.Sleep(50 * time.Millisecond)
+
+	oldConn := gr.conn
+	if err := gr.SendMetric(NewMetric("bar", "2", 1500000000)); err != nil {
+		t.Fatal(err)
+	}
+	if gr.conn == oldConn {
+		t.Error("Stale connection was not replaced")
+	}
+	srv.waitForData(t, "foo 1 1500000000\nbar 2 1500000000\n")
+}
+
+func TestNewGraphiteWriter(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+
+	err := gr.SendMetrics([]Metric{
+		NewMetric("foo", "1", 1500000000),
+		{},
+		NewMetric("bar", 2.5, 1500000001),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := "app.foo 1 1500000000\napp.bar 2.5 1500000001\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	before := time.Now().Unix()
+	if err := gr.SimpleSend("baz", "3"); err != nil {
+		t.Error(err)
+	}
+	var timestamp int64
+	if _, err := fmt.Sscanf(buf.String(), "app.baz 3 %d\n", &timestamp); err != nil {
+		t.Errorf("Unexpected output %q: %v", buf.String(), err)
+	}
+	if timestamp < before || timestamp > time.Now().Unix() {
+		t.Errorf("Wrong default timestamp %d", timestamp)
+	}
+
+	if err := gr.Disconnect(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendInterval(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	withInterval := NewMetric("foo", "1", 1500000000)
+	withInterval.Interval = 60
+	metrics := []Metric{withInterval, NewMetric("bar", "2", 1500000000)}
+
+	if err := gr.SendMetrics(metrics); err != nil {
+		t.Error(err)
+	}
+	expected := "foo 1 1500000000\nbar 2 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	gr.SendInterval = true
+	if err := gr.SendMetrics(metrics); err != nil {
+		t.Error(err)
+	}
+	expected = "foo 1 1500000000 60\nbar 2 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendTaggedMetric(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	metric := NewMetric("foo", "1", 1500000000)
+	metric.Tags = map[string]string{"region": "us", "host": "web1"}
+
+	if err := gr.SendMetric(metric); err != nil {
+		t.Error(err)
+	}
+	expected := "app.foo;host=web1;region=us 1 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+// countdownContext is a context that reports being cancelled after Err has
+// been called n times
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *countdownContext) Err() error {
+	ctx.n--
+	if ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestSendMetricsContextCancel(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	ctx := &countdownContext{Context: context.Background(), n: 2}
+
+	err := gr.SendMetricsContext(ctx, []Metric{
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("bar", "2", 1500000000),
+		NewMetric("baz", "3", 1500000000),
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if gr.writer.Buffered() != 0 {
+		t.Errorf("%d bytes left in the buffer", gr.writer.Buffered())
+	}
+	expected := "foo 1 1500000000\nbar 2 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+// noDelayConn is a net.Conn that records calls to SetNoDelay
+type noDelayConn struct {
+	net.Conn
+	noDelay bool
+}
+
+func (conn *noDelayConn) SetNoDelay(noDelay bool) error {
+	conn.noDelay = noDelay
+	return nil
+}
+
+func TestNoDelay(t *testing.T) {
+	srv := newTestServer(t)
+	gr, err := NewGraphiteFromConfig(Config{Host: "127.0.0.1", Port: srv.Port(), NoDelay: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+
+	conn := &noDelayConn{}
+	if err := gr.configureConn(conn); err != nil {
+		t.Error(err)
+	}
+	if !conn.noDelay {
+		t.Error("SetNoDelay was not called")
+	}
+}
+
+func TestLinger(t *testing.T) {
+	srv := newTestServer(t)
+	linger := 1
+	gr, err := NewGraphiteFromConfig(Config{Host: "127.0.0.1", Port: srv.Port(), Linger: &linger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if err := gr.Disconnect(); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "foo 1 1500000000\n")
+}
+
+func TestMaxLineLength(t *testing.T) {
+	var buf bytes.Buffer
+	var sendErrors []error
+	gr := NewGraphiteWriter(&buf, "")
+	gr.MaxLineLength = 20
+	gr.OnSendError = func(err error) { sendErrors = append(sendErrors, err) }
+
+	err := gr.SendMetrics([]Metric{
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("a.very.long.metric.name", "1", 1500000000),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if buf.String() != "foo 1 1500000000\n" {
+		t.Errorf("Wrote %q", buf.String())
+	}
+	if stats := gr.Stats(); stats.MetricsDropped != 1 {
+		t.Errorf("Dropped %d metrics, expected 1", stats.MetricsDropped)
+	}
+	if len(sendErrors) != 1 || !errors.Is(sendErrors[0], ErrLineTooLong) {
+		t.Errorf("Unexpected errors %v", sendErrors)
+	}
+}
+
+// failingWriter is an io.Writer whose writes fail while err is set
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func TestLastError(t *testing.T) {
+	errBrokenPipe := errors.New("broken pipe")
+	w := &failingWriter{err: errBrokenPipe}
+	gr := NewGraphiteWriter(w, "")
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err == nil {
+		t.Error("Send on a failing writer did not return an error")
+	}
+	if err := gr.LastError(); !errors.Is(err, errBrokenPipe) {
+		t.Errorf("LastError returned %v", err)
+	}
+
+	w.err = nil
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if err := gr.LastError(); err != nil {
+		t.Errorf("LastError was not cleared: %v", err)
+	}
+}
+
+// testLogger is a Logger that records the formatted lines
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (logger *testLogger) Printf(format string, v ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.lines = append(logger.lines, fmt.Sprintf(format, v...))
+}
+
+func (logger *testLogger) Lines() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]string(nil), logger.lines...)
+}
+
+func TestDebugLogging(t *testing.T) {
+	srv := newTestServer(t)
+	logger := &testLogger{}
+	gr := &Graphite{Host: "127.0.0.1", Port: srv.Port(), Protocol: TCP, Logger: logger}
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if lines := logger.Lines(); len(lines) != 0 {
+		t.Errorf("Unexpected log output %q", lines)
+	}
+
+	gr.Debug = true
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	expected := []string{
+		fmt.Sprintf("Graphite: connected to tcp://127.0.0.1:%d", srv.Port()),
+		"Graphite: flushing 17 bytes",
+	}
+	if lines := logger.Lines(); fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Errorf("Logged %q, expected %q", lines, expected)
+	}
+}
+
+func TestNopLogging(t *testing.T) {
+	logger := &testLogger{}
+	gr := NewGraphiteNop(graphiteHost, graphitePort)
+	gr.Logger = logger
+
+	gr.SendMetric(NewMetric("foo", "1", 0))
+	if lines := logger.Lines(); len(lines) != 1 || !strings.HasPrefix(lines[0], "Graphite: foo 1 ") {
+		t.Errorf("Unexpected log output %q", lines)
+	}
+
+	gr.DisableLog = true
+	gr.Debug = true
+	gr.SendMetric(NewMetric("foo", "1", 0))
+	if lines := logger.Lines(); len(lines) != 1 {
+		t.Errorf("Unexpected log output %q", lines)
+	}
+}
+
+func TestContextWithLogger(t *testing.T) {
+	logger := &testLogger{}
+	gr := NewGraphiteNop(graphiteHost, graphitePort)
+	gr.Logger = logger
+
+	requestLogger := &testLogger{}
+	ctx := ContextWithLogger(context.Background(), requestLogger)
+	gr.SendMetricsContext(ctx, []Metric{NewMetric("foo", "1", 1500000000)})
+	if lines := requestLogger.Lines(); len(lines) != 1 || !strings.HasPrefix(lines[0], "Graphite: foo 1 ") {
+		t.Errorf("Unexpected context log output %q", lines)
+	}
+	if lines := logger.Lines(); len(lines) != 0 {
+		t.Errorf("Unexpected client log output %q", lines)
+	}
+
+	gr.SendMetric(NewMetric("bar", "1", 1500000000))
+	if lines := logger.Lines(); len(lines) != 1 || len(requestLogger.Lines()) != 1 {
+		t.Errorf("The context logger was used after the send")
+	}
+}
+
+func TestNopLogSampleRate(t *testing.T) {
+	logger := &testLogger{}
+	gr := NewGraphiteNop(graphiteHost, graphitePort)
+	gr.Logger = logger
+	gr.NopLogSampleRate = 0.25
+	gr.rand = rand.New(rand.NewSource(1))
+
+	for i := 0; i < 1000; i++ {
+		gr.SendMetric(NewMetric("foo", i, 1500000000))
+	}
+
+	expected := 0
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if r.Float64() < 0.25 {
+			expected++
+		}
+	}
+	if lines := len(logger.Lines()); lines != expected || lines < 200 || lines > 300 {
+		t.Errorf("Logged %d metrics, expected %d", lines, expected)
+	}
+}
+
+func TestSimpleSendf(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	gr.clock = newFakeClock()
+
+	if err := gr.SimpleSendf("api.%s.%d.requests", "1", "users", 200); err != nil {
+		t.Error(err)
+	}
+	if expected := "app.api.users.200.requests 1 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSimpleSendMany(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+
+	if err := gr.SimpleSendMany("foo", "1", "bar", "2"); err != nil {
+		t.Error(err)
+	}
+	var foo, bar int64
+	if _, err := fmt.Sscanf(buf.String(), "foo 1 %d\nbar 2 %d\n", &foo, &bar); err != nil {
+		t.Errorf("Unexpected output %q: %v", buf.String(), err)
+	}
+	if foo == 0 || foo != bar {
+		t.Errorf("Metrics have different timestamps %d and %d", foo, bar)
+	}
+
+	buf.Reset()
+	if err := gr.SimpleSendMany("foo", "1", "bar"); err == nil {
+		t.Error("Odd argument count did not return an error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
+
+func TestSendMetricMapAt(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	values := map[string]float64{"mem.used": 1000000, "cpu.load": 0.25, "disk.free": -1}
+
+	if err := gr.SendMetricMapAt(values, time.Unix(1500000000, 0)); err != nil {
+		t.Error(err)
+	}
+	expected := "cpu.load 0.25 1500000000\ndisk.free -1 1500000000\nmem.used 1000000 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	before := time.Now().Unix()
+	if err := gr.SendMetricMap(map[string]float64{"cpu.load": 1}); err != nil {
+		t.Error(err)
+	}
+	var timestamp int64
+	if _, err := fmt.Sscanf(buf.String(), "cpu.load 1 %d\n", &timestamp); err != nil {
+		t.Errorf("Unexpected output %q: %v", buf.String(), err)
+	}
+	if timestamp < before || timestamp > time.Now().Unix() {
+		t.Errorf("Wrong default timestamp %d", timestamp)
+	}
+}
+
+func TestPrefixNormalization(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"app.":  "app.foo 1 1500000000\n",
+		"app..": "app.foo 1 1500000000\n",
+		"app":   "app.foo 1 1500000000\n",
+		".":     "foo 1 1500000000\n",
+		"":      "foo 1 1500000000\n",
+	} {
+		var buf bytes.Buffer
+		gr := NewGraphiteWriter(&buf, prefix)
+		if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+			t.Error(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("Prefix %q wrote %q, expected %q", prefix, buf.String(), expected)
+		}
+	}
+}
+
+func TestTestConnection(t *testing.T) {
+	srv := newTestServer(t)
+	if err := TestConnection(TCP, "127.0.0.1", srv.Port(), time.Second); err != nil {
+		t.Error(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	if err := TestConnection(TCP, "127.0.0.1", closedPort, time.Second); err == nil {
+		t.Error("Connecting to a closed port did not return an error")
+	}
+}
+
+func TestReset(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.Prefix = "old"
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "old.foo 1 1500000000\n")
+
+	oldConn := gr.conn
+	gr.Prefix = "new"
+	if err := gr.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if gr.conn == nil || gr.conn == oldConn {
+		t.Error("Reset did not replace the connection")
+	}
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "old.foo 1 1500000000\nnew.foo 1 1500000000\n")
+
+	if err := NewGraphiteNop(graphiteHost, graphitePort).Reset(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendMetricOK(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.MaxLineLength = 20
+
+	for _, test := range []struct {
+		metric Metric
+		sent   bool
+	}{
+		{NewMetric("foo", "1", 1500000000), true},
+		{NewMetric("", "1", 1500000000), false},
+		{Metric{}, false},
+		{NewMetric("a.very.long.metric.name", "1", 1500000000), false},
+	} {
+		sent, err := gr.SendMetricOK(test.metric)
+		if sent != test.sent || err != nil {
+			t.Errorf("Sending %#v returned (%v, %v)", test.metric, sent, err)
+		}
+	}
+	if buf.String() != "foo 1 1500000000\n" {
+		t.Errorf("Wrote %q", buf.String())
+	}
+}
+
+func TestSendWithRollup(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+
+	err := gr.SendWithRollup("web1.requests", "5", "all.requests", "summary.", "all.requests", "web1.requests")
+	if err != nil {
+		t.Error(err)
+	}
+	var timestamp int64
+	if _, err := fmt.Sscanf(buf.String(), "web1.requests 5 %d\n", &timestamp); err != nil {
+		t.Fatalf("Unexpected output %q: %v", buf.String(), err)
+	}
+	expected := fmt.Sprintf("web1.requests 5 %d\nall.requests 5 %d\nsummary.web1.requests 5 %d\n", timestamp, timestamp, timestamp)
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestMaxNameSegments(t *testing.T) {
+	var buf bytes.Buffer
+	var sendErrors []error
+	gr := NewGraphiteWriter(&buf, "app")
+	gr.MaxNameSegments = 4
+	gr.OnSendError = func(err error) { sendErrors = append(sendErrors, err) }
+
+	err := gr.SendMetrics([]Metric{
+		NewMetric("users.count", "1", 1500000000),
+		NewMetric("users.a.b.c.d.e.f.g", "1", 1500000000),
+		NewMetric("users.1234.logins", "1", 1500000000),
+		NewMetric("users.1234.sessions.5678", "1", 1500000000),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := "app.users.count 1 1500000000\napp.users.1234.logins 1 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if stats := gr.Stats(); stats.MetricsDropped != 2 {
+		t.Errorf("Dropped %d metrics, expected 2", stats.MetricsDropped)
+	}
+	if len(sendErrors) != 2 || !errors.Is(sendErrors[0], ErrTooManySegments) {
+		t.Errorf("Unexpected errors %v", sendErrors)
+	}
+}
+
+func TestLineTermination(t *testing.T) {
+	if line := frameLine("foo 1 1500000000"); line != "foo 1 1500000000\n" {
+		t.Errorf("Framed line is %q", line)
+	}
+
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.SendInterval = true
+	withInterval := NewMetric("bar", "2", 1500000000)
+	withInterval.Interval = 10
+	tagged := NewMetric("baz", "3", 1500000000)
+	tagged.Tags = map[string]string{"a": "b"}
+	if err := gr.SendMetrics([]Metric{NewMetric("foo", "1", 1500000000), withInterval, tagged}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(buf.String(), lineTerminator)
+	if len(lines) != 4 || lines[3] != "" {
+		t.Fatalf("Unexpected output %q", buf.String())
+	}
+	for _, line := range lines[:3] {
+		if strings.Count(line, lineTerminator) != 1 || strings.TrimSpace(line) == "" {
+			t.Errorf("Badly terminated line %q", line)
+		}
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	// carbon starts listening after the first attempt has failed
+	listening := make(chan *testServer, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+		if err != nil {
+			listening <- nil
+			return
+		}
+		srv := &testServer{listener: listener}
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				srv.serve(conn)
+			}
+		}()
+		listening <- srv
+	}()
+
+	gr := &Graphite{
+		Host:              "127.0.0.1",
+		Port:              port,
+		Protocol:          TCP,
+		ConnectRetries:    5,
+		ConnectRetryDelay: 20 * time.Millisecond,
+	}
+	err = gr.Connect()
+	srv := <-listening
+	if srv == nil {
+		t.Skip("Can't listen again on the same port")
+	}
+	defer srv.listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "foo 1 1500000000\n")
+}
+
+func TestSendTimeSeries(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	points := []Point{
+		{Value: "3", Timestamp: 1500000120},
+		{Value: "1", Timestamp: 1500000000},
+		{Value: "2", Timestamp: 1500000060},
+	}
+
+	if err := gr.SendTimeSeries("foo", points); err != nil {
+		t.Error(err)
+	}
+	expected := "foo 1 1500000000\nfoo 2 1500000060\nfoo 3 1500000120\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if points[0].Timestamp != 1500000120 {
+		t.Error("SendTimeSeries modified its argument")
+	}
+}
+
+func TestFirstSendDeadline(t *testing.T) {
+	// a server that accepts connections but never reads from them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	gr := &Graphite{
+		Host:     "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Protocol: TCP,
+		Timeout:  200 * time.Millisecond,
+	}
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+
+	// enough data to fill the socket buffers on both sides
+	name := strings.Repeat("x", 1000)
+	metrics := make([]Metric, 50000)
+	for i := range metrics {
+		metrics[i] = NewMetric(name, i, 1500000000)
+	}
+	done := make(chan error, 1)
+	go func() { done <- gr.SendMetrics(metrics) }()
+
+	select {
+	case err := <-done:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("The first send was not bounded by Timeout")
+	}
+}
+
+func TestSendMetricsTimed(t *testing.T) {
+	var buf bytes.Buffer
+	clock := newFakeClock()
+	clock.step = 15 * time.Millisecond
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = clock
+
+	elapsed, err := gr.SendMetricsTimed([]Metric{NewMetric("foo", "1", 0)})
+	if err != nil {
+		t.Error(err)
+	}
+	if elapsed != 30*time.Millisecond {
+		t.Errorf("Elapsed time is %v", elapsed)
+	}
+	// the zero timestamp is filled in from the same clock
+	if buf.String() != "foo 1 1500000000\n" {
+		t.Errorf("Wrote %q", buf.String())
+	}
+
+	gr.clock = nil
+	if elapsed, err := gr.SendMetricsTimed(testMetrics(10)); err != nil || elapsed < 0 {
+		t.Errorf("SendMetricsTimed returned (%v, %v)", elapsed, err)
+	}
+}
+
+func TestNoPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	relayed := NewMetric("other.app.foo", "2", 1500000000)
+	relayed.NoPrefix = true
+
+	if err := gr.SendMetrics([]Metric{NewMetric("foo", "1", 1500000000), relayed}); err != nil {
+		t.Error(err)
+	}
+	expected := "app.foo 1 1500000000\nother.app.foo 2 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestTee(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	var tee bytes.Buffer
+	gr.Tee = &tee
+
+	gr.SendMetrics([]Metric{
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("bar", "2", 1500000000),
+	})
+	expected := "foo 1 1500000000\nbar 2 1500000000\n"
+	srv.waitForData(t, expected)
+	if tee.String() != expected {
+		t.Errorf("Tee received %q, expected %q", tee.String(), expected)
+	}
+}
+
+func TestSendTypedValues(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+
+	gr.SendMetrics([]Metric{
+		NewMetric("int", 42, 1500000000),
+		NewMetric("int64", int64(-7), 1500000000),
+		NewMetric("float", 1e21, 1500000000),
+		NewMetric("small", 0.000001, 1500000000),
+		NewMetric("string", "3.14", 1500000000),
+	})
+	expected := "int 42 1500000000\n" +
+		"int64 -7 1500000000\n" +
+		"float 1000000000000000000000 1500000000\n" +
+		"small 0.000001 1500000000\n" +
+		"string 3.14 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+// partialWriter is an io.Writer that accepts limit bytes and then fails
+type partialWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+var errPartialWrite = errors.New("connection reset by peer")
+
+func (w *partialWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.buf.Write(p[:w.limit])
+		w.limit = 0
+		return n, errPartialWrite
+	}
+	w.limit -= len(p)
+	return w.buf.Write(p)
+}
+
+func TestFlushErrorDiscardsBatch(t *testing.T) {
+	w := &partialWriter{limit: 10}
+	gr := NewGraphiteWriter(w, "")
+
+	err := gr.SendMetrics([]Metric{
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("bar", "2", 1500000000),
+	})
+	if !errors.Is(err, errPartialWrite) || !strings.Contains(err.Error(), "10 of 34 buffered bytes") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	w.buf.Reset()
+	w.limit = 1000
+	if err := gr.SendMetric(NewMetric("baz", "3", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if expected := "baz 3 1500000000\n"; w.buf.String() != expected {
+		t.Errorf("Wrote %q after the failed flush, expected %q", w.buf.String(), expected)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.FormatValue = func(value interface{}) string {
+		if f, ok := value.(float64); ok {
+			return strconv.FormatInt(int64(math.Round(f)), 10)
+		}
+		return fmt.Sprint(value)
+	}
+
+	gr.SendMetrics([]Metric{
+		NewMetric("float", 2.5, 1500000000),
+		NewMetric("int", 7, 1500000000),
+	})
+	if expected := "float 3 1500000000\nint 7 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+// recordingWriter is an io.Writer that records the size of every write
+type recordingWriter struct {
+	sizes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return len(p), nil
+}
+
+func TestFlushBytesThreshold(t *testing.T) {
+	w := &recordingWriter{}
+	gr := NewGraphiteWriter(w, "")
+	gr.FlushBytesThreshold = 40
+
+	// 17 bytes per line, the threshold is crossed every third line
+	gr.SendMetrics(testMetrics(7))
+	if expected := []int{51, 51, 17}; !reflect.DeepEqual(w.sizes, expected) {
+		t.Errorf("Flushed %v bytes, expected %v", w.sizes, expected)
+	}
+}
+
+func TestRename(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	gr.Rename = func(name string) string {
+		if strings.HasPrefix(name, "legacy.") {
+			return ""
+		}
+		return strings.Replace(name, "old.", "new.", 1)
+	}
+
+	gr.SendMetrics([]Metric{
+		NewMetric("old.requests", "1", 1500000000),
+		NewMetric("legacy.requests", "2", 1500000000),
+		NewMetric("errors", "3", 1500000000),
+	})
+	expected := "app.new.requests 1 1500000000\napp.errors 3 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestUseBatchTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	clock := newFakeClock()
+	clock.step = time.Second
+	gr.clock = clock
+
+	metrics := []Metric{NewMetric("foo", 0, 0), NewMetric("foo", 1, 0), NewMetric("foo", 2, 0)}
+	gr.SendMetrics(metrics)
+	expected := "foo 0 1500000000\nfoo 1 1500000001\nfoo 2 1500000002\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	gr.UseBatchTimestamp = true
+	metrics[1].Timestamp = 1400000000
+	gr.SendMetrics(metrics)
+	expected = "foo 0 1500000003\nfoo 1 1400000000\nfoo 2 1500000003\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendNotConnected(t *testing.T) {
+	for _, protocol := range []string{TCP, UDP} {
+		gr := &Graphite{Host: "127.0.0.1", Port: 2003, Protocol: protocol}
+		if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); !errors.Is(err, ErrNotConnected) {
+			t.Errorf("Sending on an unconnected %s client returned %v", protocol, err)
+		}
+	}
+
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.Disconnect()
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Sending after Disconnect returned %v", err)
+	}
+}
+
+func TestMetricFilter(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.MetricFilter = func(metric Metric) bool {
+		return metric.Tags["debug"] != "true"
+	}
+	var sendErrors []error
+	gr.OnSendError = func(err error) { sendErrors = append(sendErrors, err) }
+
+	gr.SendMetrics([]Metric{
+		NewMetric("requests", "1", 1500000000).WithTag("debug", "true"),
+		NewMetric("errors", "2", 1500000000).WithTag("debug", "false"),
+		NewMetric("latency", "3", 1500000000),
+	})
+	if expected := "errors;debug=false 2 1500000000\nlatency 3 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if len(sendErrors) != 1 || !errors.Is(sendErrors[0], ErrFiltered) || gr.Stats().MetricsDropped != 1 {
+		t.Errorf("Unexpected errors %v", sendErrors)
+	}
+}
+
+func TestLastDialDuration(t *testing.T) {
+	srv := newTestServer(t)
+	gr := &Graphite{Host: "127.0.0.1", Port: srv.Port(), Protocol: TCP}
+	clock := newFakeClock()
+	clock.step = 15 * time.Millisecond
+	gr.clock = clock
+
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+	if d := gr.LastDialDuration(); d != 15*time.Millisecond {
+		t.Errorf("LastDialDuration is %v", d)
+	}
+}
+
+func TestManualFlush(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.ManualFlush = true
+
+	// enough to fill the write buffer several times
+	for i := 0; i < 100; i++ {
+		if err := gr.SendMetrics(testMetrics(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if data := srv.Data(); data != "" {
+		t.Fatalf("Server received %d bytes before Flush", len(data))
+	}
+
+	if err := gr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	srv.waitForData(t, strings.Repeat("foo 0 1500000000\nfoo 1 1500000000\nfoo 2 1500000000\n"+
+		"foo 3 1500000000\nfoo 4 1500000000\nfoo 5 1500000000\nfoo 6 1500000000\n"+
+		"foo 7 1500000000\nfoo 8 1500000000\nfoo 9 1500000000\n", 100))
+	if stats := gr.Stats(); stats.Flushes != 1 || stats.FlushSizeSum != 1000 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.ValidateMetrics = true
+	var sendErrors []error
+	gr.OnSendError = func(err error) { sendErrors = append(sendErrors, err) }
+
+	gr.SendMetrics([]Metric{
+		NewMetric("foo", "1", 1500000000).WithTag("region", "~us"),
+		NewMetric("bar", "2", 1500000000).WithTag("region", "us"),
+		NewMetric("baz", "three", 1500000000),
+	})
+	if expected := "bar;region=us 2 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if len(sendErrors) != 2 || !errors.Is(sendErrors[0], ErrInvalidMetric) || !errors.Is(sendErrors[1], ErrInvalidMetric) {
+		t.Errorf("Unexpected errors %v", sendErrors)
+	}
+}
+
+func TestTagStyle(t *testing.T) {
+	metric := NewMetric("requests", "1", 1500000000).WithTag("region", "us").WithTag("host", "web1.example")
+	tests := map[TagStyle]string{
+		TagStyleGraphite11:   "app.requests;host=web1.example;region=us 1 1500000000\n",
+		TagStyleCarbonZipper: "app.requests.host.web1_example.region.us 1 1500000000\n",
+	}
+	for style, expected := range tests {
+		var buf bytes.Buffer
+		gr := NewGraphiteWriter(&buf, "app")
+		gr.TagStyle = style
+		gr.SendMetric(metric)
+		if buf.String() != expected {
+			t.Errorf("Wrote %q with style %d, expected %q", buf.String(), style, expected)
+		}
+	}
+}
+
+func TestNegativeTimestamps(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+	gr.ValidateMetrics = true
+	var sendErrors []error
+	gr.OnSendError = func(err error) { sendErrors = append(sendErrors, err) }
+
+	gr.SendMetric(NewMetric("foo", "1", -1500000000))
+	if buf.Len() != 0 || len(sendErrors) != 1 || !errors.Is(sendErrors[0], ErrInvalidMetric) {
+		t.Errorf("Wrote %q with errors %v", buf.String(), sendErrors)
+	}
+
+	gr.ClampNegativeTimestamps = true
+	gr.SendMetric(NewMetric("foo", "1", -1500000000))
+	if expected := "foo 1 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	srv := newTestServer(t)
+	gr := &Graphite{Host: "127.0.0.1", Port: srv.Port(), Protocol: TCP, MaxConnectionAge: time.Minute}
+	clock := newFakeClock()
+	gr.clock = clock
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	clock.Advance(30 * time.Second)
+	gr.SendMetric(NewMetric("foo", "2", 1500000000))
+	srv.waitForData(t, "foo 1 1500000000\nfoo 2 1500000000\n")
+	clock.Advance(30 * time.Second)
+	gr.SendMetric(NewMetric("foo", "3", 1500000000))
+	srv.waitForData(t, "foo 1 1500000000\nfoo 2 1500000000\nfoo 3 1500000000\n")
+
+	srv.mu.Lock()
+	conns := len(srv.conns)
+	srv.mu.Unlock()
+	if conns != 2 {
+		t.Errorf("Opened %d connections, expected 2", conns)
+	}
+}
+
+func TestIsConnected(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	if !gr.IsConnected() {
+		t.Error("Connected client is not connected")
+	}
+	gr.Disconnect()
+	if gr.IsConnected() {
+		t.Error("Disconnected client is connected")
+	}
+	if NewGraphiteNop(graphiteHost, graphitePort).IsConnected() {
+		t.Error("Nop client is connected")
+	}
+}
+
+func TestMinFlushInterval(t *testing.T) {
+	w := &recordingWriter{}
+	gr := NewGraphiteWriter(w, "")
+	clock := newFakeClock()
+	gr.clock = clock
+	gr.MinFlushInterval = time.Second
+
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	for i := 0; i < 4; i++ {
+		clock.Advance(200 * time.Millisecond)
+		gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	}
+	if expected := []int{17}; !reflect.DeepEqual(w.sizes, expected) {
+		t.Errorf("Flushed %v bytes, expected %v", w.sizes, expected)
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	gr.Close()
+	if expected := []int{17, 85, 17}; !reflect.DeepEqual(w.sizes, expected) {
+		t.Errorf("Flushed %v bytes, expected %v", w.sizes, expected)
+	}
+}
+
+// slowWriter is an io.Writer that takes delay to complete every write
+type slowWriter struct {
+	recordingWriter
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.recordingWriter.Write(p)
+}
+
+func TestOpTimeout(t *testing.T) {
+	w := &slowWriter{delay: 20 * time.Millisecond}
+	gr := NewGraphiteWriter(w, "")
+	gr.FlushBytesThreshold = 40
+	gr.OpTimeout = 50 * time.Millisecond
+
+	// 17 bytes per line and three lines per chunk, 7 chunks in all
+	err := gr.SendMetrics(testMetrics(20))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %v, expected context.DeadlineExceeded", err)
+	}
+	if chunks := len(w.sizes); chunks < 2 || chunks >= 7 {
+		t.Errorf("Wrote %d chunks, expected the send to stop early", chunks)
+	}
+	if gr.LastError() != err {
+		t.Errorf("Last error is %v, expected %v", gr.LastError(), err)
+	}
+
+	w.sizes = nil
+	gr.OpTimeout = 0
+	if err := gr.SendMetrics(testMetrics(20)); err != nil {
+		t.Errorf("Got error %v without OpTimeout", err)
+	}
+	if len(w.sizes) != 7 {
+		t.Errorf("Wrote %d chunks, expected 7", len(w.sizes))
+	}
+}
+
+func TestTinyBufferSize(t *testing.T) {
+	w := &recordingWriter{}
+	gr := &Graphite{sink: w, BufferSize: 1}
+	gr.Connect()
+	if size := gr.writer.Size(); size != minBufferSize {
+		t.Errorf("Buffer size is %d, expected %d", size, minBufferSize)
+	}
+
+	long := NewMetric(strings.Repeat("a", 2000), "1", 1500000000)
+	if err := gr.SendMetrics([]Metric{long, NewMetric("foo", "1", 1500000000), long}); err != nil {
+		t.Error(err)
+	}
+	total := 0
+	for _, size := range w.sizes {
+		total += size
+	}
+	if expected := 2*(2000+len(" 1 1500000000\n")) + len("foo 1 1500000000\n"); total != expected {
+		t.Errorf("Wrote %d bytes, expected %d", total, expected)
+	}
+}
+
+func TestSmallBufferSize(t *testing.T) {
+	w := &recordingWriter{}
+	gr := &Graphite{sink: w, BufferSize: minBufferSize}
+	gr.Connect()
+
+	// 17 bytes per line, 30 lines fit in the buffer
+	metrics := make([]Metric, 40)
+	for i := range metrics {
+		metrics[i] = NewMetric("foo", "1", 1500000000)
+	}
+	if err := gr.SendMetrics(metrics); err != nil {
+		t.Error(err)
+	}
+	if expected := []int{30 * 17, 10 * 17}; !reflect.DeepEqual(w.sizes, expected) {
+		t.Errorf("Flushed %v bytes, expected %v", w.sizes, expected)
+	}
+}
+
+func TestConstructorsValidateAddress(t *testing.T) {
+	constructors := map[string]func(host string, port int) (*Graphite, error){
+		"NewGraphite":    NewGraphite,
+		"NewGraphiteUDP": NewGraphiteUDP,
+		"nop": func(host string, port int) (*Graphite, error) {
+			return GraphiteFactory(NOP, host, port, "")
+		},
+		"config": func(host string, port int) (*Graphite, error) {
+			return NewGraphiteFromConfig(Config{Host: host, Port: port, Protocol: "udp"})
+		},
+		"config nop": func(host string, port int) (*Graphite, error) {
+			return NewGraphiteFromConfig(Config{Host: host, Port: port, Protocol: NOP})
+		},
+	}
+	invalid := []struct {
+		host     string
+		port     int
+		expected error
+	}{
+		{"", 2003, ErrEmptyHost},
+		{"127.0.0.1", 0, ErrInvalidPort},
+		{"127.0.0.1", -1, ErrInvalidPort},
+		{"127.0.0.1", 70000, ErrInvalidPort},
+	}
+	for name, constructor := range constructors {
+		for _, test := range invalid {
+			if strings.HasPrefix(name, "config") && test.port == 0 {
+				continue // defaults to 2003
+			}
+			gr, err := constructor(test.host, test.port)
+			if !errors.Is(err, test.expected) {
+				t.Errorf("%s(%q, %d) returned %v, expected %v", name, test.host, test.port, err, test.expected)
+			}
+			if gr != nil {
+				t.Errorf("%s(%q, %d) returned a client", name, test.host, test.port)
+			}
+		}
+	}
+
+	if gr, err := GraphiteFactory(NOP, "127.0.0.1", 2003, ""); err != nil || !gr.IsNop() {
+		t.Errorf("GraphiteFactory returned %v, %v for a valid address", gr, err)
+	}
+	if _, err := GraphiteFactory("http", "127.0.0.1", 2003, ""); err == nil {
+		t.Error("GraphiteFactory accepted an unsupported protocol")
+	}
+	// it can't return an error, so it stands in for unconfigured clients
+	if gr := NewGraphiteNop("", 0); gr == nil || !gr.IsNop() {
+		t.Error("NewGraphiteNop didn't return a nop client for an empty address")
+	}
+}
+
+func TestResetWhileSending(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+
+	const senders, sends = 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				if err := gr.SendMetric(NewMetric("foo", j, 1500000000)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := gr.Reset(); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	gr.Disconnect()
+
+	// lines from different connections may interleave, so only count them
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(srv.Data(), "\n") < senders*sends && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if lines := strings.Count(srv.Data(), "\n"); lines != senders*sends {
+		t.Errorf("Server received %d lines, expected %d", lines, senders*sends)
+	}
+	srv.mu.Lock()
+	conns := len(srv.conns)
+	srv.mu.Unlock()
+	if conns != 11 {
+		t.Errorf("Server accepted %d connections, expected 11", conns)
+	}
+}
+
+func TestNopCountsMatchLive(t *testing.T) {
+	metrics := []Metric{
+		{},
+		NewMetric("foo", "1", 1500000000),
+		NewMetric("debug.foo", "2", 1500000000),
+		NewMetric("a.very.long.metric.name", "3", 1500000000),
+		NewMetric("bar", "4", 0),
+	}
+	configure := func(gr *Graphite) {
+		gr.DisableLog = true
+		gr.MaxLineLength = 25
+		gr.MetricFilter = func(metric Metric) bool {
+			return !strings.HasPrefix(metric.Name, "debug.")
+		}
+	}
+	var buf bytes.Buffer
+	live := NewGraphiteWriter(&buf, "")
+	configure(live)
+	nop := NewGraphiteNop(graphiteHost, graphitePort)
+	configure(nop)
+
+	for _, metric := range metrics {
+		liveSent, _ := live.SendMetricOK(metric)
+		nopSent, _ := nop.SendMetricOK(metric)
+		if liveSent != nopSent {
+			t.Errorf("Sending %#v returned %v in nop mode, %v in live mode", metric, nopSent, liveSent)
+		}
+	}
+	live.SendMetrics(metrics)
+	nop.SendMetrics(metrics)
+	if liveStats, nopStats := live.Stats(), nop.Stats(); liveStats.MetricsSent != 4 || nopStats.MetricsSent != liveStats.MetricsSent || nopStats.MetricsDropped != liveStats.MetricsDropped {
+		t.Errorf("Stats are %+v in nop mode, %+v in live mode", nopStats, liveStats)
+	}
+}
+
+func TestSendEmptyBatch(t *testing.T) {
+	w := &recordingWriter{}
+	gr := NewGraphiteWriter(w, "")
+	gr.ReportDropped = true
+	gr.broken = true
+
+	for _, metrics := range [][]Metric{nil, {}, {{}, {Value: "1"}}} {
+		if err := gr.SendMetrics(metrics); err != nil {
+			t.Errorf("Sending %v returned %v", metrics, err)
+		}
+	}
+	if sent, err := gr.SendMetricOK(Metric{}); sent || err != nil {
+		t.Errorf("Sending a zeroed metric returned (%v, %v)", sent, err)
+	}
+	if len(w.sizes) != 0 {
+		t.Errorf("Wrote %v bytes for empty batches", w.sizes)
+	}
+	if stats := gr.Stats(); stats != (Stats{}) {
+		t.Errorf("Empty batches changed the stats to %+v", stats)
+	}
+	if !gr.broken {
+		t.Error("Empty batches reconnected")
+	}
+}
+
+func TestTimestampOffset(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+	gr.TimestampOffset = -90 * time.Second
+
+	gr.SendMetric(NewMetric("foo", "1", 0))
+	gr.SendMetric(NewMetric("foo", "2", 1400000000))
+	gr.SimpleSend("bar", "3")
+	expected := "foo 1 1499999910\n" +
+		"foo 2 1400000000\n" +
+		"bar 3 1499999910\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestTimestampOffsetAll(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+	gr.TimestampOffset = -90 * time.Second
+	gr.TimestampOffsetAll = true
+	gr.ReportFlushCount = true
+
+	gr.SendMetric(NewMetric("foo", "1", 0))
+	gr.SendMetric(NewMetric("foo", "2", 1400000000))
+	gr.SimpleSend("bar", "3")
+	expected := "foo 1 1499999910\n" +
+		"graphite.flush.count 1 1499999910\n" +
+		"foo 2 1399999910\n" +
+		"graphite.flush.count 1 1499999910\n" +
+		"bar 3 1499999910\n" +
+		"graphite.flush.count 1 1499999910\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestConnectRetriesDontBlock(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	gr := &Graphite{
+		Host:              "127.0.0.1",
+		Port:              port,
+		Protocol:          TCP,
+		ConnectRetries:    2,
+		ConnectRetryDelay: 100 * time.Millisecond,
+	}
+	done := make(chan error, 1)
+	go func() { done <- gr.Connect() }()
+	time.Sleep(20 * time.Millisecond)
+
+	// the client is usable while Connect waits to retry
+	start := time.Now()
+	gr.Stats()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Stats was blocked for %v by the connect backoff", elapsed)
+	}
+	if err := <-done; err == nil {
+		t.Error("Connecting to a closed port did not return an error")
+	}
+
+	// a reconnection from a send only tries once
+	gr.broken = true
+	start = time.Now()
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err == nil {
+		t.Error("Sending to a closed port did not return an error")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Reconnecting from a send took %v", elapsed)
+	}
+}
+
+func TestOpTimeoutReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.OpTimeout = 50 * time.Millisecond
+	gr.broken = true
+	// a relay that never completes the handshake
+	gr.dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	err := gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %v, expected context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Reconnecting took %v, expected it to stop after OpTimeout", elapsed)
+	}
+}
+
+func TestMaxConnectionAgeDialFailure(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	clock := newFakeClock()
+	gr.clock = clock
+	gr.connectedAt = clock.Now()
+	gr.MaxConnectionAge = time.Minute
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	srv.waitForData(t, "foo 1 1500000000\n")
+	clock.Advance(2 * time.Minute)
+	errRefused := errors.New("connection refused")
+	gr.dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errRefused
+	}
+	if err := gr.SendMetric(NewMetric("foo", "2", 1500000000)); !errors.Is(err, errRefused) {
+		t.Errorf("Got error %v, expected the dial error", err)
+	}
+	gr.dialContext = nil
+	if err := gr.SendMetric(NewMetric("foo", "3", 1500000000)); err != nil {
+		t.Errorf("Got error %v after the relay came back", err)
+	}
+	srv.waitForData(t, "foo 1 1500000000\nfoo 3 1500000000\n")
+}
+
+func TestConnectFlushesHeldMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.clock = newFakeClock()
+	gr.MinFlushInterval = time.Minute
+
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	gr.SendMetric(NewMetric("foo", "2", 1500000000))
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	srv.waitForData(t, "foo 1 1500000000\nfoo 2 1500000000\n")
+	gr.SendMetric(NewMetric("foo", "3", 1500000000))
+	gr.Close()
+	srv.waitForData(t, "foo 1 1500000000\nfoo 2 1500000000\nfoo 3 1500000000\n")
+}
+
+func TestFilteredBatchSkipsReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.MetricFilter = func(metric Metric) bool { return metric.Name != "skip" }
+	gr.broken = true
+	gr.lastErr = errors.New("broken pipe")
+
+	if err := gr.SendMetrics([]Metric{NewMetric("skip", "1", 1500000000)}); err != nil {
+		t.Error(err)
+	}
+	if reconnects := gr.Stats().Reconnects; reconnects != 0 {
+		t.Errorf("Reconnected %d times for a filtered batch", reconnects)
+	}
+	if gr.LastError() == nil {
+		t.Error("A filtered batch cleared LastError")
+	}
+}
+
+func TestDisconnectReportsFlushError(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+
+	w := &failingWriter{}
+	gr := NewGraphiteWriter(w, "")
+	gr.ManualFlush = true
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	w.err = errBroken
+	if err := gr.Close(); !errors.Is(err, errBroken) {
+		t.Errorf("Close returned %v, expected the error of the final flush", err)
+	}
+
+	w = &failingWriter{}
+	gr = NewGraphiteWriter(w, "")
+	gr.clock = newFakeClock()
+	gr.MinFlushInterval = time.Minute
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	w.err = errBroken
+	gr.SendMetric(NewMetric("foo", "2", 1500000000))
+	if err := gr.Disconnect(); !errors.Is(err, errBroken) {
+		t.Errorf("Disconnect returned %v, expected the error of the final flush", err)
+	}
+}
+
+func TestCloseContextBlockedConn(t *testing.T) {
+	// a relay that accepts connections and never reads
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	gr := &Graphite{Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, Protocol: TCP, ManualFlush: true}
+	if err := gr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { (<-accepted).Close() }()
+	// far more than the socket buffers can hold
+	name := strings.Repeat("a", 1000)
+	metrics := make([]Metric, 50000)
+	for i := range metrics {
+		metrics[i] = NewMetric(name, i, 1500000000)
+	}
+	gr.SendMetrics(metrics)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = gr.CloseContext(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("CloseContext took %v", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "dropped 50000 metrics") {
+		t.Errorf("CloseContext returned %v, expected a timeout dropping 50000 metrics", err)
+	}
+	if gr.conn != nil {
+		t.Error("CloseContext didn't close the connection")
+	}
+}
+
 // Uncomment the following method to test sending an actual metric to graphite
 //
 //func TestSendMetric(t *testing.T) {
@@ -0,0 +1,66 @@
+// Package graphiteprom exports the state of a Graphite client as Prometheus
+// metrics. It's a separate package so that the graphite package doesn't
+// depend on the Prometheus client library; building it requires
+// github.com/prometheus/client_golang.
+package graphiteprom
+
+import (
+	graphite "github.com/marpaia/graphite-golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector is a prometheus.Collector reading the Stats of a Graphite client
+type collector struct {
+	client        *graphite.Graphite
+	sent          *prometheus.Desc
+	dropped       *prometheus.Desc
+	sendErrors    *prometheus.Desc
+	flushes       *prometheus.Desc
+	reconnects    *prometheus.Desc
+	udpReconnects *prometheus.Desc
+	connected     *prometheus.Desc
+}
+
+// NewCollector returns a prometheus.Collector exposing the Stats of client as
+// graphite_client_* counters, and whether it's connected as the
+// graphite_client_connected gauge
+func NewCollector(client *graphite.Graphite) prometheus.Collector {
+	return &collector{
+		client:        client,
+		sent:          prometheus.NewDesc("graphite_client_metrics_sent_total", "Number of metrics written to the connection.", nil, nil),
+		dropped:       prometheus.NewDesc("graphite_client_metrics_dropped_total", "Number of metrics dropped because they failed a check.", nil, nil),
+		sendErrors:    prometheus.NewDesc("graphite_client_send_errors_total", "Number of sends that failed.", nil, nil),
+		flushes:       prometheus.NewDesc("graphite_client_flushes_total", "Number of writes of buffered metrics to the connection.", nil, nil),
+		reconnects:    prometheus.NewDesc("graphite_client_reconnects_total", "Number of connections made after the first.", nil, nil),
+		udpReconnects: prometheus.NewDesc("graphite_client_udp_reconnects_total", "Number of UDP reconnections after refused writes.", nil, nil),
+		connected:     prometheus.NewDesc("graphite_client_connected", "Whether the client is connected and its last send succeeded.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sent
+	ch <- c.dropped
+	ch <- c.sendErrors
+	ch <- c.flushes
+	ch <- c.reconnects
+	ch <- c.udpReconnects
+	ch <- c.connected
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.Stats()
+	ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(stats.MetricsSent))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.MetricsDropped))
+	ch <- prometheus.MustNewConstMetric(c.sendErrors, prometheus.CounterValue, float64(stats.SendErrors))
+	ch <- prometheus.MustNewConstMetric(c.flushes, prometheus.CounterValue, float64(stats.Flushes))
+	ch <- prometheus.MustNewConstMetric(c.reconnects, prometheus.CounterValue, float64(stats.Reconnects))
+	ch <- prometheus.MustNewConstMetric(c.udpReconnects, prometheus.CounterValue, float64(stats.UDPReconnects))
+
+	connected := 0.0
+	if c.client.IsConnected() {
+		connected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, connected)
+}
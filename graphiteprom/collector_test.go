@@ -0,0 +1,53 @@
+package graphiteprom
+
+import (
+	"bytes"
+	"testing"
+
+	graphite "github.com/marpaia/graphite-golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	var buf bytes.Buffer
+	client := graphite.NewGraphiteWriter(&buf, "")
+	client.MaxLineLength = 20
+	client.SendMetrics([]graphite.Metric{
+		graphite.NewMetric("foo", "1", 1500000000),
+		graphite.NewMetric("bar", "2", 1500000000),
+		graphite.NewMetric("a.very.long.metric.name", "3", 1500000000),
+	})
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(NewCollector(client)); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			values[family.GetName()] = metric.GetCounter().GetValue()
+		} else {
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		"graphite_client_metrics_sent_total":    2,
+		"graphite_client_metrics_dropped_total": 1,
+		"graphite_client_send_errors_total":     0,
+		"graphite_client_flushes_total":         1,
+		"graphite_client_reconnects_total":      0,
+		"graphite_client_udp_reconnects_total":  0,
+		"graphite_client_connected":             1,
+	}
+	for name, value := range expected {
+		if got, ok := values[name]; !ok || got != value {
+			t.Errorf("%s is %v, expected %v", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package graphitetest provides fake implementations of graphite.Client for
+// the tests of code sending metrics.
+package graphitetest
+
+import (
+	"sync"
+	"time"
+
+	graphite "github.com/marpaia/graphite-golang"
+)
+
+// NopClient is a graphite.Client that discards every metric and never fails
+type NopClient struct{}
+
+func (NopClient) Connect() error                             { return nil }
+func (NopClient) Disconnect() error                          { return nil }
+func (NopClient) Flush() error                               { return nil }
+func (NopClient) Close() error                               { return nil }
+func (NopClient) SendMetric(graphite.Metric) error           { return nil }
+func (NopClient) SendMetrics([]graphite.Metric) error        { return nil }
+func (NopClient) SimpleSend(stat string, value string) error { return nil }
+
+// RecordingClient is a graphite.Client that keeps every metric sent to it, in
+// order, so that tests can check them. The zero value is ready to use and it's
+// safe for concurrent use.
+type RecordingClient struct {
+	mu      sync.Mutex
+	metrics []graphite.Metric
+}
+
+func (client *RecordingClient) Connect() error    { return nil }
+func (client *RecordingClient) Disconnect() error { return nil }
+func (client *RecordingClient) Flush() error      { return nil }
+func (client *RecordingClient) Close() error      { return nil }
+
+// SendMetric records metric
+func (client *RecordingClient) SendMetric(metric graphite.Metric) error {
+	return client.SendMetrics([]graphite.Metric{metric})
+}
+
+// SendMetrics records metrics
+func (client *RecordingClient) SendMetrics(metrics []graphite.Metric) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.metrics = append(client.metrics, metrics...)
+	return nil
+}
+
+// SimpleSend records a metric with the current time, like
+// graphite.Graphite.SimpleSend would send
+func (client *RecordingClient) SimpleSend(stat string, value string) error {
+	return client.SendMetric(graphite.NewMetric(stat, value, time.Now().Unix()))
+}
+
+// Metrics returns a copy of the metrics recorded so far
+func (client *RecordingClient) Metrics() []graphite.Metric {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return append([]graphite.Metric(nil), client.metrics...)
+}
+
+// SentNames returns the names of the metrics recorded so far, in order
+func (client *RecordingClient) SentNames() []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	names := make([]string, len(client.metrics))
+	for i, metric := range client.metrics {
+		names[i] = metric.Name
+	}
+	return names
+}
+
+// Reset forgets the metrics recorded so far
+func (client *RecordingClient) Reset() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.metrics = nil
+}
@@ -0,0 +1,98 @@
+package graphitetest
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	graphite "github.com/marpaia/graphite-golang"
+)
+
+// reportLogins is an example of code under test, accepting a graphite.Client
+func reportLogins(client graphite.Client, ok, failed int) error {
+	return client.SendMetrics([]graphite.Metric{
+		graphite.NewMetric("logins.ok", ok, 1500000000),
+		graphite.NewMetric("logins.failed", failed, 1500000000),
+	})
+}
+
+func TestRecordingClient(t *testing.T) {
+	client := &RecordingClient{}
+	if err := reportLogins(client, 3, 1); err != nil {
+		t.Error(err)
+	}
+	client.SimpleSend("logins.total", "4")
+
+	metrics := client.Metrics()
+	if len(metrics) != 3 {
+		t.Fatalf("Recorded %d metrics, expected 3", len(metrics))
+	}
+	if metrics[0].Name != "logins.ok" || metrics[0].Value != 3 {
+		t.Errorf("First metric is %v, expected logins.ok 3", metrics[0])
+	}
+	if metrics[1].Name != "logins.failed" || metrics[1].Value != 1 {
+		t.Errorf("Second metric is %v, expected logins.failed 1", metrics[1])
+	}
+	if metrics[2].Name != "logins.total" || metrics[2].Value != "4" || metrics[2].Timestamp == 0 {
+		t.Errorf("Third metric is %v, expected logins.total 4 with a timestamp", metrics[2])
+	}
+}
+
+func TestNopClient(t *testing.T) {
+	if err := reportLogins(NopClient{}, 3, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordingClientSentNames(t *testing.T) {
+	client := &RecordingClient{}
+	client.SendMetric(graphite.NewMetric("foo", "1", 1500000000))
+	client.SendMetrics([]graphite.Metric{
+		graphite.NewMetric("bar", "2", 1500000000),
+		graphite.NewMetric("foo", "3", 1500000000),
+	})
+	client.SimpleSend("baz", "4")
+
+	if names, expected := client.SentNames(), []string{"foo", "bar", "foo", "baz"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Sent %v, expected %v", names, expected)
+	}
+
+	client.Reset()
+	if names := client.SentNames(); len(names) != 0 {
+		t.Errorf("Sent %v after Reset, expected nothing", names)
+	}
+	client.SimpleSend("foo", "5")
+	if names, expected := client.SentNames(), []string{"foo"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Sent %v, expected %v", names, expected)
+	}
+}
+
+func TestRecordingClientMetricsCopy(t *testing.T) {
+	client := &RecordingClient{}
+	client.SimpleSend("foo", "1")
+
+	metrics := client.Metrics()
+	metrics[0].Name = "changed"
+	if names := client.SentNames(); names[0] != "foo" {
+		t.Errorf("Recorded %q, expected the copy not to change it", names[0])
+	}
+}
+
+func TestRecordingClientConcurrent(t *testing.T) {
+	client := &RecordingClient{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				client.SimpleSend("foo", "1")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(client.Metrics()); n != 1000 {
+		t.Errorf("Recorded %d metrics, expected 1000", n)
+	}
+}
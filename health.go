@@ -0,0 +1,46 @@
+package graphite
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthStatus is the JSON body written by HealthHandler
+type healthStatus struct {
+	State     string `json:"state"`
+	LastError string `json:"last_error,omitempty"`
+	Stats     Stats  `json:"stats"`
+}
+
+// HealthHandler returns an http.Handler for readiness and liveness probes. It
+// responds with 200 when the client is in nop mode or connected and its last
+// operation succeeded, and with 503 otherwise. The body is a JSON object with
+// the state ("connected", "nop" or "disconnected"), the LastError, if any, and
+// the Stats.
+func (graphite *Graphite) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		graphite.mu.Lock()
+		status := healthStatus{Stats: graphite.stats}
+		healthy := true
+		switch {
+		case graphite.nop:
+			status.State = StateNop.String()
+		case graphite.writer != nil:
+			status.State = StateConnected.String()
+			healthy = graphite.lastErr == nil
+		default:
+			status.State = "disconnected"
+			healthy = false
+		}
+		if graphite.lastErr != nil {
+			status.LastError = graphite.lastErr.Error()
+		}
+		graphite.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,44 @@
+package graphite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func checkHealth(t *testing.T, gr *Graphite, code int, expected healthStatus) {
+	rec := httptest.NewRecorder()
+	gr.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rec.Code != code {
+		t.Errorf("Status is %d, expected %d", rec.Code, code)
+	}
+	var status healthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status != expected {
+		t.Errorf("Status is %#v, expected %#v", status, expected)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.MaxLineLength = 10
+	gr.SendMetric(NewMetric("a.long.metric.name", "1", 1500000000))
+	checkHealth(t, gr, http.StatusOK, healthStatus{State: "connected", Stats: Stats{MetricsDropped: 1}})
+
+	gr.Disconnect()
+	gr.Port = 0
+	gr.Connect()
+	checkHealth(t, gr, http.StatusServiceUnavailable, healthStatus{
+		State:     "disconnected",
+		LastError: gr.LastError().Error(),
+		Stats:     Stats{MetricsDropped: 1},
+	})
+
+	nop := NewGraphiteNop(graphiteHost, graphitePort)
+	checkHealth(t, nop, http.StatusOK, healthStatus{State: "nop"})
+}
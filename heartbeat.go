@@ -0,0 +1,107 @@
+package graphite
+
+import (
+	"sync"
+	"time"
+)
+
+// StartHeartbeat sends a metric called name every interval, so that dashboards
+// and alerts can tell when the application or the client stop sending. The
+// value counts the heartbeats sent, starting from 1, so that missed ones show
+// up as gaps. The returned function stops the heartbeat and waits for it to
+// exit; it must be called before Close.
+func (graphite *Graphite) StartHeartbeat(name string, interval time.Duration) (stop func()) {
+	var count int64
+	return graphite.every(interval, func(now time.Time) {
+		count++
+		graphite.mu.Lock()
+		graphite.sendMetrics([]Metric{NewMetricInt(name, count, graphite.clientTime(now).Unix())})
+		graphite.mu.Unlock()
+	})
+}
+
+// StartSelfReport sends the counters of Stats every interval, as metrics named
+// after their JSON names under prefix, e.g. prefix.metrics_sent, to monitor
+// the metrics pipeline itself. The reports count as sent metrics like any
+// other, adding a fixed number per interval. The returned function stops the
+// reports and waits for them to exit; it must be called before Close.
+func (graphite *Graphite) StartSelfReport(interval time.Duration, prefix string) (stop func()) {
+	prefix = metricPrefix(prefix)
+	return graphite.every(interval, func(now time.Time) {
+		graphite.mu.Lock()
+		defer graphite.mu.Unlock()
+
+		stats := graphite.stats
+		timestamp := graphite.clientTime(now).Unix()
+		graphite.sendMetrics([]Metric{
+			NewMetricInt(prefix+"metrics_sent", int64(stats.MetricsSent), timestamp),
+			NewMetricInt(prefix+"metrics_dropped", int64(stats.MetricsDropped), timestamp),
+			NewMetricInt(prefix+"send_errors", int64(stats.SendErrors), timestamp),
+			NewMetricInt(prefix+"flushes", int64(stats.Flushes), timestamp),
+			NewMetricInt(prefix+"reconnects", int64(stats.Reconnects), timestamp),
+			NewMetricInt(prefix+"udp_reconnects", int64(stats.UDPReconnects), timestamp),
+		})
+	})
+}
+
+// startAutoFlush flushes the metrics left in the buffer every interval, see
+// AutoFlushInterval
+func (graphite *Graphite) startAutoFlush(interval time.Duration) (stop func()) {
+	return graphite.every(interval, func(time.Time) {
+		graphite.mu.Lock()
+		defer graphite.mu.Unlock()
+
+		if graphite.held.Len() > 0 || graphite.writer != nil && graphite.writer.Buffered() > 0 {
+			graphite.debugf("Graphite: flushing idle buffer")
+			if err := graphite.flush(); err != nil {
+				graphite.lastErr = err
+			}
+		}
+	})
+}
+
+// takeAutoFlusher detaches the goroutine started by startAutoFlush, if any,
+// and returns the function stopping it. The caller must hold graphite.mu and
+// disconnect before releasing it, so that no send starts another goroutine in
+// between, and must call the function after releasing it, since the goroutine
+// may be waiting for graphite.mu.
+func (graphite *Graphite) takeAutoFlusher() (stop func()) {
+	stop = graphite.stopAutoFlush
+	graphite.stopAutoFlush = nil
+	if stop == nil {
+		return func() {}
+	}
+	return stop
+}
+
+// every calls f with the tick time every interval, according to the client
+// clock, in a new goroutine. The returned function stops it and waits for the
+// goroutine to exit, it can be called more than once.
+func (graphite *Graphite) every(interval time.Duration, f func(time.Time)) (stop func()) {
+	ticker := graphite.newTicker(interval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C():
+				f(now)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStartHeartbeat(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	clock := newFakeClock()
+	gr.clock = clock
+
+	stop := gr.StartHeartbeat("heartbeat", 10*time.Second)
+	clock.Advance(5 * time.Second)
+	clock.Advance(25 * time.Second)
+	stop()
+	clock.Advance(time.Minute)
+	stop()
+
+	expected := "app.heartbeat 1 1500000010\n" +
+		"app.heartbeat 2 1500000020\n" +
+		"app.heartbeat 3 1500000030\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestStartSelfReport(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	clock := newFakeClock()
+	gr.clock = clock
+
+	gr.SendMetrics(testMetrics(3))
+	stop := gr.StartSelfReport(time.Minute, "graphite.client.")
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	stop()
+
+	expected := "foo 0 1500000000\nfoo 1 1500000000\nfoo 2 1500000000\n" +
+		"graphite.client.metrics_sent 3 1500000060\n" +
+		"graphite.client.metrics_dropped 0 1500000060\n" +
+		"graphite.client.send_errors 0 1500000060\n" +
+		"graphite.client.flushes 1 1500000060\n" +
+		"graphite.client.reconnects 0 1500000060\n" +
+		"graphite.client.udp_reconnects 0 1500000060\n" +
+		"graphite.client.metrics_sent 9 1500000120\n" +
+		"graphite.client.metrics_dropped 0 1500000120\n" +
+		"graphite.client.send_errors 0 1500000120\n" +
+		"graphite.client.flushes 2 1500000120\n" +
+		"graphite.client.reconnects 0 1500000120\n" +
+		"graphite.client.udp_reconnects 0 1500000120\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestAutoFlushInterval(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	clock := newFakeClock()
+	gr.clock = clock
+	gr.ManualFlush = true
+	gr.AutoFlushInterval = 10 * time.Second
+
+	gr.SendMetrics(testMetrics(2))
+	clock.Advance(5 * time.Second)
+	if buf.Len() != 0 {
+		t.Errorf("Wrote %q before the interval", buf.String())
+	}
+	// the second tick is only received once the first flush is done
+	clock.Advance(5 * time.Second)
+	clock.Advance(10 * time.Second)
+	if expected := "foo 0 1500000000\nfoo 1 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if flushes := gr.Stats().Flushes; flushes != 1 {
+		t.Errorf("Flushed %d times, expected 1", flushes)
+	}
+	gr.Close()
+}
+
+func TestAutoFlushStopsOnDisconnect(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	clock := newFakeClock()
+	gr.clock = clock
+	gr.ManualFlush = true
+	gr.AutoFlushInterval = 10 * time.Second
+
+	gr.SendMetrics(testMetrics(1))
+	if err := gr.Disconnect(); err != nil {
+		t.Error(err)
+	}
+	if gr.stopAutoFlush != nil {
+		t.Error("Disconnect didn't stop the auto flush")
+	}
+	clock.mu.Lock()
+	for _, ticker := range clock.tickers {
+		if !ticker.stopped {
+			t.Error("Disconnect left the auto flush ticker running")
+		}
+	}
+	clock.mu.Unlock()
+	// no goroutine is left to receive the tick
+	clock.Advance(10 * time.Second)
+
+	// sending after reconnecting starts it again
+	gr.Connect()
+	gr.SendMetrics(testMetrics(1))
+	if gr.stopAutoFlush == nil {
+		t.Error("The auto flush didn't restart after reconnecting")
+	}
+	gr.Close()
+}
+
+func TestAutoFlushDisconnectWhileSending(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		gr := NewGraphiteWriter(&buf, "")
+		gr.AutoFlushInterval = time.Hour
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 10; j++ {
+				gr.SendMetrics(testMetrics(1))
+			}
+		}()
+		gr.Disconnect()
+		<-done
+
+		gr.mu.Lock()
+		running := gr.stopAutoFlush != nil
+		gr.mu.Unlock()
+		if running {
+			t.Fatal("A send during Disconnect left the auto flush running")
+		}
+	}
+}
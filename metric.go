@@ -1,15 +1,31 @@
 package graphite
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Metric is a struct that defines the relevant properties of a graphite metric
 type Metric struct {
-	Name      string
+	Name string
+	// Value is sent as is when it's a string, integers and floats are
+	// formatted like NewMetricInt and NewMetricFloat do
 	Value     interface{}
 	Timestamp int64
+	// Interval is an optional step hint in seconds, sent only when
+	// Graphite.SendInterval is set
+	Interval int
+	// NoPrefix sends the metric without the prefix of the client, for
+	// metrics that are already fully qualified
+	NoPrefix bool
+	// Tags are sent using the Graphite 1.1 tagged series format,
+	// "name;tag1=value1;tag2=value2", sorted by tag name
+	Tags map[string]string
 }
 
 func NewMetric(name string, value interface{}, timestamp int64) Metric {
@@ -20,11 +36,331 @@ func NewMetric(name string, value interface{}, timestamp int64) Metric {
 	}
 }
 
+// Point is a value of a series at a given time, see SendTimeSeries
+type Point struct {
+	Value     interface{}
+	Timestamp int64
+}
+
+// NewMetricFloat creates a Metric with a float value. The value is rendered in
+// fixed-point notation, because carbon rejects the 1e+06 exponent notation
+// that Go uses by default for very large and very small numbers.
+func NewMetricFloat(name string, value float64, timestamp int64) Metric {
+	return NewMetric(name, formatFloat(value), timestamp)
+}
+
+// NewMetricInt creates a Metric with an integer value
+func NewMetricInt(name string, value int64, timestamp int64) Metric {
+	return NewMetric(name, strconv.FormatInt(value, 10), timestamp)
+}
+
+// formatFloat renders value in the shortest fixed-point notation that
+// represents it exactly
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// formatValue renders the value of a metric for the plaintext protocol.
+// Strings are sent as they are, integers in decimal and floats like
+// NewMetricFloat does, so that callers can pass numbers in Metric.Value
+// directly.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return formatFloat(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case int:
+		return strconv.Itoa(v)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	}
+	return fmt.Sprint(value)
+}
+
+// ErrMalformedLine is returned by ParseMetric for lines that are not in the
+// carbon plaintext format
+var ErrMalformedLine = errors.New("graphite: malformed line")
+
+// ParseMetric parses a line in the carbon plaintext format, "name value
+// timestamp", into a Metric. Tags in the name are parsed into Metric.Tags and
+// the value is kept as a string. The optional fourth field written with
+// Graphite.SendInterval is parsed into Metric.Interval.
+func ParseMetric(line string) (Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 && len(fields) != 4 {
+		return Metric{}, fmt.Errorf("%w: %q", ErrMalformedLine, line)
+	}
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return Metric{}, fmt.Errorf("%w: invalid timestamp in %q", ErrMalformedLine, line)
+	}
+
+	path := strings.Split(fields[0], ";")
+	metric := NewMetric(path[0], fields[1], timestamp)
+	if len(fields) == 4 {
+		if metric.Interval, err = strconv.Atoi(fields[3]); err != nil || metric.Interval < 0 {
+			return Metric{}, fmt.Errorf("%w: invalid interval in %q", ErrMalformedLine, line)
+		}
+	}
+	if metric.Name == "" {
+		return Metric{}, fmt.Errorf("%w: empty name in %q", ErrMalformedLine, line)
+	}
+	for _, tag := range path[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return Metric{}, fmt.Errorf("%w: invalid tag in %q", ErrMalformedLine, line)
+		}
+		if metric.Tags == nil {
+			metric.Tags = make(map[string]string)
+		}
+		metric.Tags[kv[0]] = kv[1]
+	}
+	return metric, nil
+}
+
+// IsZero reports whether metric is the zero Metric, which is skipped when
+// sending
+func (metric Metric) IsZero() bool {
+	return metric.Name == "" && metric.Value == nil && metric.Timestamp == 0 &&
+		metric.Interval == 0 && !metric.NoPrefix && len(metric.Tags) == 0
+}
+
+// Equal reports whether metric and other have the same fields, comparing
+// tags regardless of their order. Metric can't be compared with == because of
+// the Tags map.
+func (metric Metric) Equal(other Metric) bool {
+	if metric.Name != other.Name || metric.Timestamp != other.Timestamp ||
+		metric.Interval != other.Interval || metric.NoPrefix != other.NoPrefix ||
+		len(metric.Tags) != len(other.Tags) {
+		return false
+	}
+	for key, value := range metric.Tags {
+		if otherValue, ok := other.Tags[key]; !ok || otherValue != value {
+			return false
+		}
+	}
+	return reflect.DeepEqual(metric.Value, other.Value)
+}
+
+// WithTag returns a copy of metric with the tag name set to value. The tags of
+// metric are copied, not modified, e.g.
+//
+//	metric := graphite.NewMetric("app.latency", "12", ts).
+//	    WithTag("region", "us").
+//	    WithTag("host", "web1")
+func (metric Metric) WithTag(name, value string) Metric {
+	tags := make(map[string]string, len(metric.Tags)+1)
+	for key, tagValue := range metric.Tags {
+		tags[key] = tagValue
+	}
+	tags[name] = value
+	metric.Tags = tags
+	return metric
+}
+
+// ErrInvalidMetric is returned by Validate for metrics that carbon would
+// reject or misparse
+var ErrInvalidMetric = errors.New("graphite: invalid metric")
+
+// Validate checks that metric can be sent: it must have a name, a numeric
+// value, a non-negative timestamp, and no whitespace in the name, value or
+// tags. Tags follow the rules of Graphite 1.1: names are not empty and don't
+// contain any of ;!^= (nor does the metric name), values are not empty, don't
+// contain ; and don't start with ~.
+func (metric Metric) Validate() error {
+	if metric.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidMetric)
+	}
+	invalidName := " \t\r\n;"
+	if len(metric.Tags) > 0 {
+		invalidName = invalidTagName
+	}
+	if strings.ContainsAny(metric.Name, invalidName) {
+		return fmt.Errorf("%w: invalid character in name %q", ErrInvalidMetric, metric.Name)
+	}
+	if metric.Value == nil {
+		return fmt.Errorf("%w: no value for %s", ErrInvalidMetric, metric.Name)
+	}
+	if value := formatValue(metric.Value); strings.ContainsAny(value, " \t\r\n") {
+		return fmt.Errorf("%w: invalid value %q for %s", ErrInvalidMetric, value, metric.Name)
+	} else if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return fmt.Errorf("%w: non-numeric value %q for %s", ErrInvalidMetric, value, metric.Name)
+	}
+	if metric.Timestamp < 0 {
+		return fmt.Errorf("%w: negative timestamp %d for %s", ErrInvalidMetric, metric.Timestamp, metric.Name)
+	}
+	keys := make([]string, 0, len(metric.Tags))
+	for key := range metric.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := metric.Tags[key]
+		switch {
+		case key == "":
+			return fmt.Errorf("%w: empty tag name for %s", ErrInvalidMetric, metric.Name)
+		case strings.ContainsAny(key, invalidTagName):
+			return fmt.Errorf("%w: invalid character in tag name %q for %s", ErrInvalidMetric, key, metric.Name)
+		case value == "":
+			return fmt.Errorf("%w: empty value for tag %s of %s", ErrInvalidMetric, key, metric.Name)
+		case strings.ContainsAny(value, " \t\r\n;"):
+			return fmt.Errorf("%w: invalid character in value %q of tag %s of %s", ErrInvalidMetric, value, key, metric.Name)
+		case strings.HasPrefix(value, "~"):
+			return fmt.Errorf("%w: value %q of tag %s of %s starts with ~", ErrInvalidMetric, value, key, metric.Name)
+		}
+	}
+	return nil
+}
+
+// invalidTagName has the characters Graphite 1.1 doesn't allow in tag names
+// and in the names of tagged series, plus whitespace
+const invalidTagName = " \t\r\n;!^="
+
+// ValidateBatch validates every metric in metrics, returning the errors of
+// all the invalid ones, each prefixed by the index of the metric, or nil if
+// they are all valid
+func ValidateBatch(metrics []Metric) []error {
+	var errs []error
+	for i, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("metric %d: %w", i, err))
+		}
+	}
+	return errs
+}
+
+// tagString returns the tags in the ";tag=value" format, sorted by tag name
+func (metric Metric) tagString() string {
+	if len(metric.Tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(metric.Tags))
+	for key := range metric.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, key := range keys {
+		buf.WriteString(";")
+		buf.WriteString(key)
+		buf.WriteString("=")
+		buf.WriteString(metric.Tags[key])
+	}
+	return buf.String()
+}
+
+// pathTagString returns the tags as ".tag.value" path segments, sorted by tag
+// name, with the dots in them replaced by underscores
+func (metric Metric) pathTagString() string {
+	if len(metric.Tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(metric.Tags))
+	for key := range metric.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, key := range keys {
+		buf.WriteString(".")
+		buf.WriteString(strings.Replace(key, ".", "_", -1))
+		buf.WriteString(".")
+		buf.WriteString(strings.Replace(metric.Tags[key], ".", "_", -1))
+	}
+	return buf.String()
+}
+
 func (metric Metric) String() string {
 	return fmt.Sprintf(
-		"%s %s %s",
+		"%s%s %s %s",
 		metric.Name,
-		metric.Value,
+		metric.tagString(),
+		formatValue(metric.Value),
 		time.Unix(metric.Timestamp, 0).Format("2006-01-02 15:04:05"),
 	)
 }
+
+// MetricBuilder builds a Metric with a fluent API, e.g.
+//
+//	metric := graphite.NewMetricBuilder("app.latency").
+//	    Value(12.3).
+//	    Tag("region", "us").
+//	    At(time.Now()).
+//	    Build()
+type MetricBuilder struct {
+	metric Metric
+}
+
+// NewMetricBuilder starts building a Metric called name
+func NewMetricBuilder(name string) *MetricBuilder {
+	return &MetricBuilder{metric: Metric{Name: name}}
+}
+
+// Value sets the value of the metric, floats are formatted like
+// NewMetricFloat does
+func (builder *MetricBuilder) Value(value interface{}) *MetricBuilder {
+	switch v := value.(type) {
+	case float64:
+		builder.metric.Value = formatFloat(v)
+	case float32:
+		builder.metric.Value = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		builder.metric.Value = value
+	}
+	return builder
+}
+
+// Tag adds a tag to the metric
+func (builder *MetricBuilder) Tag(name, value string) *MetricBuilder {
+	if builder.metric.Tags == nil {
+		builder.metric.Tags = make(map[string]string)
+	}
+	builder.metric.Tags[name] = value
+	return builder
+}
+
+// At sets the timestamp of the metric
+func (builder *MetricBuilder) At(t time.Time) *MetricBuilder {
+	builder.metric.Timestamp = t.Unix()
+	return builder
+}
+
+// Interval sets the step hint of the metric, in seconds
+func (builder *MetricBuilder) Interval(seconds int) *MetricBuilder {
+	builder.metric.Interval = seconds
+	return builder
+}
+
+// Build returns the metric. The builder can still be used afterwards, and
+// changing it doesn't affect the metrics it has already built.
+func (builder *MetricBuilder) Build() Metric {
+	metric := builder.metric
+	if metric.Tags != nil {
+		metric.Tags = make(map[string]string, len(builder.metric.Tags))
+		for name, value := range builder.metric.Tags {
+			metric.Tags[name] = value
+		}
+	}
+	return metric
+}
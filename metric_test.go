@@ -0,0 +1,194 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricEqual(t *testing.T) {
+	a := NewMetric("foo", "1", 1500000000)
+	a.Tags = map[string]string{}
+	a.Tags["region"] = "us"
+	a.Tags["host"] = "web1"
+
+	b := NewMetric("foo", "1", 1500000000)
+	b.Tags = map[string]string{}
+	b.Tags["host"] = "web1"
+	b.Tags["region"] = "us"
+
+	if !a.Equal(b) || !b.Equal(a) {
+		t.Error("Metrics with the same tags are not equal")
+	}
+
+	b.Tags["region"] = "eu"
+	if a.Equal(b) {
+		t.Error("Metrics with different tag values are equal")
+	}
+	delete(b.Tags, "region")
+	if a.Equal(b) || b.Equal(a) {
+		t.Error("Metrics with different tag sets are equal")
+	}
+
+	if a.Equal(NewMetric("foo", "2", 1500000000)) {
+		t.Error("Metrics with different values are equal")
+	}
+	if !NewMetric("foo", []int{1}, 0).Equal(NewMetric("foo", []int{1}, 0)) {
+		t.Error("Metrics with uncomparable values are not equal")
+	}
+}
+
+func TestMetricIsZero(t *testing.T) {
+	if !(Metric{}).IsZero() {
+		t.Error("Zero metric is not zero")
+	}
+	if (Metric{Tags: map[string]string{"a": "b"}}).IsZero() {
+		t.Error("Tagged metric is zero")
+	}
+	if NewMetric("foo", "1", 0).IsZero() {
+		t.Error("Named metric is zero")
+	}
+}
+
+func TestNewMetricFloat(t *testing.T) {
+	for value, expected := range map[float64]string{
+		-12.5:     "-12.5",
+		1000000.0: "1000000",
+		0.0000001: "0.0000001",
+		3:         "3",
+	} {
+		metric := NewMetricFloat("foo", value, 1500000000)
+		if metric.Value != expected {
+			t.Errorf("Formatted %v as %q, expected %q", value, metric.Value, expected)
+		}
+	}
+}
+
+func TestParseMetric(t *testing.T) {
+	metric, err := ParseMetric("foo.bar;host=web1;region=us 12.5 1500000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NewMetric("foo.bar", "12.5", 1500000000)
+	expected.Tags = map[string]string{"host": "web1", "region": "us"}
+	if !metric.Equal(expected) {
+		t.Errorf("Parsed %#v, expected %#v", metric, expected)
+	}
+
+	metric, err = ParseMetric("foo 1 1500000000 60")
+	if err != nil || metric.Interval != 60 {
+		t.Errorf("Parsed %#v, %v, expected an interval of 60", metric, err)
+	}
+
+	for _, line := range []string{"", "foo 1", "foo 1 now", "foo;tag 1 1500000000", " 1 2 3 4 5", "foo 1 1500000000 often"} {
+		if _, err := ParseMetric(line); err == nil {
+			t.Errorf("Parsed malformed line %q", line)
+		}
+	}
+}
+
+func TestMetricBuilder(t *testing.T) {
+	builder := NewMetricBuilder("app.latency").
+		Value(12.3).
+		Tag("region", "us").
+		Tag("host", "web1").
+		At(time.Unix(1500000000, 0))
+	metric := builder.Build()
+
+	expected := NewMetric("app.latency", "12.3", 1500000000)
+	expected.Tags = map[string]string{"region": "us", "host": "web1"}
+	if !metric.Equal(expected) {
+		t.Errorf("Built %#v, expected %#v", metric, expected)
+	}
+
+	other := builder.Tag("region", "eu").Value(1000000.0).Interval(60).Build()
+	if metric.Tags["region"] != "us" {
+		t.Error("Changing the builder modified a built metric")
+	}
+	if other.Tags["region"] != "eu" || other.Value != "1000000" || other.Interval != 60 {
+		t.Errorf("Unexpected metric %#v", other)
+	}
+	if v := NewMetricBuilder("foo").Value(42).Build().Value; v != 42 {
+		t.Errorf("Unexpected value %#v", v)
+	}
+}
+
+func TestNewMetricInt(t *testing.T) {
+	if metric := NewMetricInt("foo", -42, 1500000000); metric.Value != "-42" {
+		t.Errorf("Unexpected value %#v", metric.Value)
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	metrics := []Metric{
+		NewMetric("foo", 1, 1500000000),
+		NewMetric("", 1, 1500000000),
+		NewMetric("foo bar", 1, 1500000000),
+		NewMetric("foo", "1 2", 1500000000),
+		NewMetric("foo", "abc", 1500000000),
+		NewMetric("foo", nil, 1500000000),
+		NewMetric("foo", 1.5, -1),
+		NewMetricBuilder("foo").Value(1).Tag("a=b", "c").Build(),
+		NewMetricBuilder("foo").Value(1).Tag("region", "us").Build(),
+	}
+
+	errs := ValidateBatch(metrics)
+	if len(errs) != 7 {
+		t.Fatalf("Expected 7 errors, got %v", errs)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, ErrInvalidMetric) || !strings.HasPrefix(err.Error(), fmt.Sprintf("metric %d: ", i+1)) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if errs := ValidateBatch(metrics[:1]); errs != nil {
+		t.Errorf("Valid batch returned %v", errs)
+	}
+}
+
+func TestMetricWithTag(t *testing.T) {
+	base := NewMetric("foo", "1", 1500000000).WithTag("region", "us")
+	tagged := base.WithTag("host", "web1").WithTag("region", "eu")
+
+	if len(base.Tags) != 1 || base.Tags["region"] != "us" {
+		t.Errorf("WithTag modified the original tags %v", base.Tags)
+	}
+	if len(tagged.Tags) != 2 || tagged.Tags["region"] != "eu" || tagged.Tags["host"] != "web1" {
+		t.Errorf("Unexpected tags %v", tagged.Tags)
+	}
+	if tagged.Name != "foo" || tagged.Value != "1" || tagged.Timestamp != 1500000000 {
+		t.Errorf("Unexpected metric %#v", tagged)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	tests := []struct {
+		name  string
+		tags  map[string]string
+		valid bool
+	}{
+		{"foo", map[string]string{"region": "us-east", "host": "web~1"}, true},
+		{"foo", map[string]string{"": "us"}, false},
+		{"foo", map[string]string{"region": ""}, false},
+		{"foo", map[string]string{"region": "~us"}, false},
+		{"foo", map[string]string{"region": "us;eu"}, false},
+		{"foo", map[string]string{"re!gion": "us"}, false},
+		{"foo", map[string]string{"re^gion": "us"}, false},
+		{"foo", map[string]string{"re=gion": "us"}, false},
+		{"foo!bar", map[string]string{"region": "us"}, false},
+		{"foo!bar", nil, true},
+	}
+	for _, test := range tests {
+		metric := NewMetric(test.name, "1", 1500000000)
+		metric.Tags = test.tags
+		err := metric.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s %v is invalid: %v", test.name, test.tags, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidMetric) {
+			t.Errorf("%s %v is valid", test.name, test.tags)
+		}
+	}
+}
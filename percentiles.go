@@ -0,0 +1,59 @@
+package graphite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SendPercentiles sends summary statistics of samples as one batch with the
+// current timestamp: name.count, name.min, name.max, name.mean and, for each
+// of percentiles, between 0 and 100, name.pN, e.g. name.p50 and name.p99_9
+// for 50 and 99.9. Percentiles are computed on a sorted copy of samples,
+// interpolating linearly between the two closest ranks, like the default
+// method of NumPy and R. Only name.count is sent when samples is empty.
+func (graphite *Graphite) SendPercentiles(name string, samples []float64, percentiles ...float64) error {
+	for _, p := range percentiles {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("graphite: percentile %v is not between 0 and 100", p)
+		}
+	}
+
+	timestamp := graphite.timestampNow().Unix()
+	metrics := []Metric{NewMetricInt(name+".count", int64(len(samples)), timestamp)}
+	if len(samples) > 0 {
+		sorted := make([]float64, len(samples))
+		copy(sorted, samples)
+		sort.Float64s(sorted)
+
+		sum := 0.0
+		for _, sample := range sorted {
+			sum += sample
+		}
+		metrics = append(metrics,
+			NewMetricFloat(name+".min", sorted[0], timestamp),
+			NewMetricFloat(name+".max", sorted[len(sorted)-1], timestamp),
+			NewMetricFloat(name+".mean", sum/float64(len(sorted)), timestamp),
+		)
+		for _, p := range percentiles {
+			suffix := strings.Replace(formatFloat(p), ".", "_", 1)
+			metrics = append(metrics, NewMetricFloat(name+".p"+suffix, percentile(sorted, p), timestamp))
+		}
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
+
+// percentile returns the p-th percentile of the sorted, non-empty, samples
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	fraction := rank - float64(lower)
+	return sorted[lower] + fraction*(sorted[lower+1]-sorted[lower])
+}
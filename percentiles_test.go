@@ -0,0 +1,40 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSendPercentiles(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+
+	samples := []float64{7, 3, 10, 1, 9, 2, 8, 4, 6, 5}
+	if err := gr.SendPercentiles("latency", samples, 25, 50, 75, 100); err != nil {
+		t.Fatal(err)
+	}
+	expected := "latency.count 10 1500000000\n" +
+		"latency.min 1 1500000000\n" +
+		"latency.max 10 1500000000\n" +
+		"latency.mean 5.5 1500000000\n" +
+		"latency.p25 3.25 1500000000\n" +
+		"latency.p50 5.5 1500000000\n" +
+		"latency.p75 7.75 1500000000\n" +
+		"latency.p100 10 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if samples[0] != 7 {
+		t.Error("SendPercentiles sorted the samples in place")
+	}
+
+	buf.Reset()
+	gr.SendPercentiles("empty", nil, 99.9)
+	if expected := "empty.count 0 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if err := gr.SendPercentiles("latency", samples, 101); err == nil {
+		t.Error("Percentile 101 was accepted")
+	}
+}
@@ -0,0 +1,93 @@
+package graphite
+
+import (
+	"time"
+)
+
+// Pool is a pool of up to MaxSize TCP connections to the same Graphite host,
+// for applications sending from many goroutines at a rate a single
+// connection can't keep up with. Each connection is a Graphite client used by
+// one goroutine at a time, the pool grows on demand and Get blocks when all
+// the connections are in use.
+type Pool struct {
+	Host    string
+	Port    int
+	Prefix  string
+	Timeout time.Duration
+	MaxSize int
+	idle    chan *Graphite
+	slots   chan struct{}
+}
+
+// NewPool is a factory method that's used to create a new Pool of up to
+// maxSize connections, which are only opened when needed
+func NewPool(host string, port int, prefix string, maxSize int) *Pool {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &Pool{
+		Host:    host,
+		Port:    port,
+		Prefix:  prefix,
+		MaxSize: maxSize,
+		idle:    make(chan *Graphite, maxSize),
+		slots:   make(chan struct{}, maxSize),
+	}
+}
+
+// Get returns an idle connection of the pool, or a new one if there is none
+// and the pool has less than MaxSize connections, waiting for one to be
+// returned otherwise. The connection must be given back with Put.
+func (pool *Pool) Get() (*Graphite, error) {
+	pool.slots <- struct{}{}
+	select {
+	case graphite := <-pool.idle:
+		return graphite, nil
+	default:
+	}
+
+	graphite := &Graphite{Host: pool.Host, Port: pool.Port, Protocol: "tcp", Prefix: pool.Prefix, Timeout: pool.Timeout}
+	if err := graphite.Connect(); err != nil {
+		<-pool.slots
+		return nil, err
+	}
+	return graphite, nil
+}
+
+// Put returns a connection obtained from Get to the pool. Connections whose
+// last send failed are closed instead, so that Get opens a fresh one.
+func (pool *Pool) Put(graphite *Graphite) {
+	if graphite.LastError() != nil {
+		graphite.Disconnect()
+	} else {
+		pool.idle <- graphite
+	}
+	<-pool.slots
+}
+
+// SendMetrics sends metrics through a connection of the pool
+func (pool *Pool) SendMetrics(metrics []Metric) error {
+	graphite, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	defer pool.Put(graphite)
+
+	return graphite.SendMetrics(metrics)
+}
+
+// Close closes the idle connections of the pool, connections in use are
+// closed when they are returned with Put
+func (pool *Pool) Close() error {
+	var err error
+	for {
+		select {
+		case graphite := <-pool.idle:
+			if closeErr := graphite.Disconnect(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package graphite
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolConcurrentSends(t *testing.T) {
+	srv := newTestServer(t)
+	pool := NewPool("127.0.0.1", srv.Port(), "app", 3)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := pool.SendMetrics(testMetrics(2)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(srv.Data(), "\n") < 800 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if lines := strings.Count(srv.Data(), "\n"); lines != 800 {
+		t.Errorf("Server received %d lines, expected 800", lines)
+	}
+	srv.mu.Lock()
+	conns := len(srv.conns)
+	srv.mu.Unlock()
+	if conns > 3 {
+		t.Errorf("The pool opened %d connections", conns)
+	}
+}
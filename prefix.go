@@ -0,0 +1,49 @@
+package graphite
+
+import (
+	"strings"
+)
+
+// SetPrefix changes the prefix of the metrics sent from now on. It's the same
+// as setting Prefix, but safe to call while other goroutines are sending.
+// Segments pushed with PushPrefix are kept and still follow the new prefix.
+func (graphite *Graphite) SetPrefix(prefix string) {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	graphite.Prefix = prefix
+}
+
+// PushPrefix appends segment to the prefix of the metrics sent from now on,
+// after Prefix and the segments pushed before, until PopPrefix removes it
+func (graphite *Graphite) PushPrefix(segment string) {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	graphite.prefixStack = append(graphite.prefixStack, segment)
+}
+
+// PopPrefix removes the segment pushed last by PushPrefix, if any
+func (graphite *Graphite) PopPrefix() {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	if n := len(graphite.prefixStack); n > 0 {
+		graphite.prefixStack = graphite.prefixStack[:n-1]
+	}
+}
+
+// effectivePrefix returns Prefix followed by the pushed segments, the caller
+// must hold graphite.mu
+func (graphite *Graphite) effectivePrefix() string {
+	if len(graphite.prefixStack) == 0 {
+		return graphite.Prefix
+	}
+	segments := make([]string, 0, len(graphite.prefixStack)+1)
+	for _, segment := range append([]string{graphite.Prefix}, graphite.prefixStack...) {
+		if segment = strings.Trim(segment, "."); segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, ".")
+}
@@ -0,0 +1,32 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPushPopPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app.")
+
+	gr.PushPrefix("http")
+	gr.SendMetric(NewMetric("requests", "1", 1500000000))
+	gr.PushPrefix("handler.")
+	gr.SendMetric(NewMetric("requests", "2", 1500000000))
+	gr.SetPrefix("web")
+	gr.SendMetric(NewMetric("requests", "3", 1500000000))
+	gr.PopPrefix()
+	gr.SendMetric(NewMetric("requests", "4", 1500000000))
+	gr.PopPrefix()
+	gr.PopPrefix()
+	gr.SendMetric(NewMetric("requests", "5", 1500000000))
+
+	expected := "app.http.requests 1 1500000000\n" +
+		"app.http.handler.requests 2 1500000000\n" +
+		"web.http.handler.requests 3 1500000000\n" +
+		"web.http.requests 4 1500000000\n" +
+		"web.requests 5 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,129 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// readerBatchSize is the number of lines SendFromReader and SendFromChannel
+// send at a time
+const readerBatchSize = 100
+
+// channelFlushInterval is the longest SendFromChannel holds a partial batch
+const channelFlushInterval = time.Second
+
+// SendFromReader reads lines in the carbon plaintext format from r, parses
+// them with ParseMetric and sends them in batches, applying the client prefix.
+// Empty lines are ignored and malformed ones are dropped, or make it return an
+// error, after sending the metrics before it, when FailOnMalformed is set. It
+// returns the number of metrics sent.
+func (graphite *Graphite) SendFromReader(r io.Reader) (int, error) {
+	sent := 0
+	batch := make([]Metric, 0, readerBatchSize)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		metric, err := ParseMetric(line)
+		if err != nil {
+			if graphite.FailOnMalformed {
+				// don't lose the metrics read before the malformed line
+				n, sendErr := graphite.sendBatch(batch)
+				if sendErr != nil {
+					err = errors.Join(err, sendErr)
+				}
+				return sent + n, err
+			}
+			graphite.mu.Lock()
+			graphite.dropMetric(err)
+			graphite.mu.Unlock()
+			continue
+		}
+		batch = append(batch, metric)
+		if len(batch) == readerBatchSize {
+			n, err := graphite.sendBatch(batch)
+			sent += n
+			if err != nil {
+				return sent, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sent, err
+	}
+	n, err := graphite.sendBatch(batch)
+	return sent + n, err
+}
+
+// SendFromChannel sends the metrics received from ch until it's closed, in
+// batches of up to 100 metrics, and sends the partial batch at least once a
+// second, so that a metric waits for at most a second however slowly they
+// arrive. It keeps going when a batch fails and returns the first error after
+// ch is closed and the last batch is sent.
+func (graphite *Graphite) SendFromChannel(ch <-chan Metric) error {
+	ticker := graphite.newTicker(channelFlushInterval)
+	defer ticker.Stop()
+
+	var firstErr error
+	send := func(batch []Metric) {
+		if _, err := graphite.sendBatch(batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	batch := make([]Metric, 0, readerBatchSize)
+	for {
+		select {
+		case metric, ok := <-ch:
+			if !ok {
+				send(batch)
+				return firstErr
+			}
+			batch = append(batch, metric)
+			if len(batch) < readerBatchSize {
+				continue
+			}
+		case <-ticker.C():
+		}
+		send(batch)
+		batch = batch[:0]
+	}
+}
+
+// SendMetricsStream sends the metrics returned by next, until it returns false,
+// in batches of up to 100 metrics, so that huge sends don't need all their
+// metrics in memory at once. It stops at the first batch that fails.
+func (graphite *Graphite) SendMetricsStream(next func() (Metric, bool)) error {
+	batch := make([]Metric, 0, readerBatchSize)
+	for {
+		metric, ok := next()
+		if ok {
+			batch = append(batch, metric)
+			if len(batch) < readerBatchSize {
+				continue
+			}
+		}
+		if _, err := graphite.sendBatch(batch); err != nil || !ok {
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+// sendBatch locks the client and sends metrics, returning how many were sent
+func (graphite *Graphite) sendBatch(metrics []Metric) (int, error) {
+	if len(metrics) == 0 {
+		return 0, nil
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetricsContext(context.Background(), metrics)
+}
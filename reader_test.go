@@ -0,0 +1,137 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const replayInput = `foo 1 1500000000
+not a metric line
+bar;region=us 2.5 1500000001
+
+baz 3 1500000002
+`
+
+func TestSendFromReader(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "replay")
+
+	sent, err := gr.SendFromReader(strings.NewReader(replayInput))
+	if err != nil {
+		t.Error(err)
+	}
+	if sent != 3 {
+		t.Errorf("Sent %d metrics, expected 3", sent)
+	}
+	expected := "replay.foo 1 1500000000\nreplay.bar;region=us 2.5 1500000001\nreplay.baz 3 1500000002\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if stats := gr.Stats(); stats.MetricsDropped != 1 {
+		t.Errorf("Dropped %d metrics, expected 1", stats.MetricsDropped)
+	}
+}
+
+func TestSendFromReaderFailOnMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.FailOnMalformed = true
+
+	sent, err := gr.SendFromReader(strings.NewReader(replayInput))
+	if !errors.Is(err, ErrMalformedLine) {
+		t.Errorf("Expected ErrMalformedLine, got %v", err)
+	}
+	if sent != 1 || buf.String() != "foo 1 1500000000\n" {
+		t.Errorf("Sent %d metrics: %q, expected only the line before the malformed one", sent, buf.String())
+	}
+}
+
+func TestSendFromReaderReplay(t *testing.T) {
+	var out bytes.Buffer
+	gr := NewGraphiteWriter(&out, "")
+	gr.SendInterval = true
+	gr.SendMetrics([]Metric{
+		NewMetricBuilder("foo").Value(1).At(time.Unix(1500000000, 0)).Interval(60).Build(),
+		NewMetric("bar", "2", 1500000000),
+	})
+
+	var replayed bytes.Buffer
+	replay := NewGraphiteWriter(&replayed, "")
+	replay.SendInterval = true
+	replay.FailOnMalformed = true
+	if sent, err := replay.SendFromReader(strings.NewReader(out.String())); sent != 2 || err != nil {
+		t.Errorf("Replay returned (%d, %v)", sent, err)
+	}
+	if replayed.String() != out.String() {
+		t.Errorf("Replayed %q, expected %q", replayed.String(), out.String())
+	}
+}
+
+func TestSendFromChannel(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+	gr.Prefix = "stream"
+	clock := newFakeClock()
+	gr.clock = clock
+
+	ch := make(chan Metric)
+	done := make(chan error, 1)
+	go func() { done <- gr.SendFromChannel(ch) }()
+
+	// a partial batch is sent when the flush interval elapses
+	ch <- NewMetric("foo", 1, 1500000000)
+	clock.Advance(time.Second)
+	srv.waitForData(t, "stream.foo 1 1500000000\n")
+
+	for i := 0; i < 250; i++ {
+		ch <- NewMetric("bar", i, 1500000000)
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(srv.Data(), "\n") < 251 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if lines := strings.Count(srv.Data(), "stream.bar "); lines != 250 {
+		t.Errorf("Server received %d lines, expected 250", lines)
+	}
+}
+
+// lineCounter is an io.Writer that counts the lines written to it
+type lineCounter struct {
+	lines int
+}
+
+func (w *lineCounter) Write(p []byte) (int, error) {
+	w.lines += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
+
+func TestSendMetricsStream(t *testing.T) {
+	w := &lineCounter{}
+	gr := NewGraphiteWriter(w, "")
+
+	const count = 100050
+	i := 0
+	err := gr.SendMetricsStream(func() (Metric, bool) {
+		if i == count {
+			return Metric{}, false
+		}
+		i++
+		return NewMetric("foo", i, 1500000000), true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if w.lines != count {
+		t.Errorf("Wrote %d lines, expected %d", w.lines, count)
+	}
+	if flushes := gr.Stats().Flushes; flushes < count/readerBatchSize {
+		t.Errorf("Only %d flushes for %d metrics", flushes, count)
+	}
+}
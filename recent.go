@@ -0,0 +1,75 @@
+package graphite
+
+// RecentLines returns the last RetainRecent lines written to the connection,
+// oldest first and without the newline, to check what the client actually
+// sent
+func (graphite *Graphite) RecentLines() []string {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.orderedRecent()
+}
+
+// orderedRecent returns a copy of the retained lines, oldest first, the caller
+// must hold graphite.mu
+func (graphite *Graphite) orderedRecent() []string {
+	lines := make([]string, 0, len(graphite.recent))
+	lines = append(lines, graphite.recent[graphite.recentNext:]...)
+	return append(lines, graphite.recent[:graphite.recentNext]...)
+}
+
+// queueRecent records line, written to the buffer or held back, to be retained
+// once it's flushed, keeping at most RetainRecent lines; the caller must hold
+// graphite.mu
+func (graphite *Graphite) queueRecent(line string) {
+	if graphite.RetainRecent <= 0 {
+		if graphite.recent != nil || graphite.recentQueued != nil {
+			graphite.recent = nil
+			graphite.recentNext = 0
+			graphite.recentQueued = nil
+		}
+		return
+	}
+	graphite.recentQueued = append(graphite.recentQueued, line)
+	if extra := len(graphite.recentQueued) - graphite.RetainRecent; extra > 0 {
+		graphite.recentQueued = append(graphite.recentQueued[:0], graphite.recentQueued[extra:]...)
+	}
+}
+
+// retainQueued retains the lines queued by queueRecent after a successful
+// flush, the caller must hold graphite.mu
+func (graphite *Graphite) retainQueued() {
+	for _, line := range graphite.recentQueued {
+		graphite.retainRecent(line)
+	}
+	graphite.recentQueued = graphite.recentQueued[:0]
+}
+
+// retainRecent adds line to the lines returned by RecentLines, replacing the
+// oldest one when there are already RetainRecent, the caller must hold
+// graphite.mu
+func (graphite *Graphite) retainRecent(line string) {
+	size := graphite.RetainRecent
+	if size <= 0 {
+		graphite.recent = nil
+		graphite.recentNext = 0
+		return
+	}
+	if len(graphite.recent) < size && graphite.recentNext == 0 {
+		graphite.recent = append(graphite.recent, line)
+		return
+	}
+	if len(graphite.recent) != size {
+		// RetainRecent changed after the ring filled up: start again from
+		// the most recent lines
+		lines := graphite.orderedRecent()
+		if len(lines) > size-1 {
+			lines = lines[len(lines)-(size-1):]
+		}
+		graphite.recent = append(lines, line)
+		graphite.recentNext = 0
+		return
+	}
+	graphite.recent[graphite.recentNext] = line
+	graphite.recentNext = (graphite.recentNext + 1) % size
+}
@@ -0,0 +1,88 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRecentLines(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	if lines := gr.RecentLines(); len(lines) != 0 {
+		t.Errorf("Retained %q without RetainRecent", lines)
+	}
+
+	gr.RetainRecent = 3
+	gr.SendMetrics(testMetrics(2))
+	expected := []string{"app.foo 0 1500000000", "app.foo 1 1500000000"}
+	if lines := gr.RecentLines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Retained %q, expected %q", lines, expected)
+	}
+
+	gr.SendMetrics(testMetrics(5))
+	expected = []string{"app.foo 2 1500000000", "app.foo 3 1500000000", "app.foo 4 1500000000"}
+	if lines := gr.RecentLines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Retained %q, expected %q", lines, expected)
+	}
+
+	gr.RetainRecent = 2
+	gr.SendMetric(NewMetric("bar", "1", 1500000000))
+	expected = []string{"app.foo 4 1500000000", "app.bar 1 1500000000"}
+	if lines := gr.RecentLines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Retained %q, expected %q", lines, expected)
+	}
+
+	gr.RetainRecent = 0
+	gr.SendMetric(NewMetric("bar", "2", 1500000000))
+	if lines := gr.RecentLines(); len(lines) != 0 {
+		t.Errorf("Retained %q after disabling RetainRecent", lines)
+	}
+}
+
+func TestRecentLinesBounded(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.RetainRecent = 10
+
+	for i := 0; i < 1000; i++ {
+		gr.SendMetric(NewMetric(fmt.Sprintf("foo%d", i), "1", 1500000000))
+	}
+	lines := gr.RecentLines()
+	if len(lines) != 10 || lines[0] != "foo990 1 1500000000" || lines[9] != "foo999 1 1500000000" {
+		t.Errorf("Retained %q, expected the last 10 lines", lines)
+	}
+	if cap(gr.recent) > 2*gr.RetainRecent {
+		t.Errorf("Ring buffer grew to %d", cap(gr.recent))
+	}
+}
+
+func TestRecentLinesAfterWrite(t *testing.T) {
+	w := &failingWriter{}
+	gr := NewGraphiteWriter(w, "")
+	gr.RetainRecent = 3
+	gr.ManualFlush = true
+
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	if lines := gr.RecentLines(); len(lines) != 0 {
+		t.Errorf("Retained %q before flushing", lines)
+	}
+	if err := gr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"foo 1 1500000000"}
+	if lines := gr.RecentLines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Retained %q, expected %q", lines, expected)
+	}
+
+	w.err = errors.New("broken pipe")
+	gr.SendMetric(NewMetric("bar", "1", 1500000000))
+	if err := gr.Flush(); err == nil {
+		t.Error("Flush didn't fail")
+	}
+	if lines := gr.RecentLines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Retained %q after a failed write, expected %q", lines, expected)
+	}
+}
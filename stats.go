@@ -0,0 +1,59 @@
+package graphite
+
+// Stats is a snapshot of the counters of a Graphite client
+type Stats struct {
+	// MetricsSent is the number of metrics written to the connection
+	MetricsSent uint64 `json:"metrics_sent"`
+	// MetricsDropped is the number of metrics that were not sent because
+	// they failed a check, such as MaxLineLength
+	MetricsDropped uint64 `json:"metrics_dropped"`
+	// SendErrors is the number of sends that failed, including short UDP
+	// writes
+	SendErrors uint64 `json:"send_errors"`
+	// Flushes is the number of successful writes of buffered metrics to the
+	// connection, i.e. of TCP buffer flushes and UDP datagrams, and the
+	// FlushSize fields describe how many metrics they carried
+	Flushes      uint64 `json:"flushes"`
+	FlushSizeMin uint64 `json:"flush_size_min"`
+	FlushSizeMax uint64 `json:"flush_size_max"`
+	FlushSizeSum uint64 `json:"flush_size_sum"`
+	// UDPRetries is the number of times a UDP datagram was sent again after
+	// the kernel reported its buffers full (ENOBUFS)
+	UDPRetries uint64 `json:"udp_retries"`
+	// Reconnects is the number of connections made after the first, e.g. by
+	// sends after a failed flush, MaxConnectionAge, CheckConnBeforeSend,
+	// Reset or UDP AutoReconnect
+	Reconnects uint64 `json:"reconnects"`
+	// UDPReconnects is the number of times a refused UDP write made
+	// AutoReconnect dial the address again
+	UDPReconnects uint64 `json:"udp_reconnects"`
+}
+
+// AverageFlushSize returns the average number of metrics per flush
+func (stats Stats) AverageFlushSize() float64 {
+	if stats.Flushes == 0 {
+		return 0
+	}
+	return float64(stats.FlushSizeSum) / float64(stats.Flushes)
+}
+
+// recordFlush accounts for a flush of size metrics
+func (stats *Stats) recordFlush(size int) {
+	n := uint64(size)
+	if stats.Flushes == 0 || n < stats.FlushSizeMin {
+		stats.FlushSizeMin = n
+	}
+	if n > stats.FlushSizeMax {
+		stats.FlushSizeMax = n
+	}
+	stats.Flushes++
+	stats.FlushSizeSum += n
+}
+
+// Stats returns a snapshot of the client counters
+func (graphite *Graphite) Stats() Stats {
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.stats
+}
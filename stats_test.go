@@ -0,0 +1,113 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFlushSizeStats(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+
+	for _, size := range []int{3, 1, 5, 0} {
+		if err := gr.SendMetrics(testMetrics(size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := gr.Stats()
+	if stats.Flushes != 3 || stats.FlushSizeMin != 1 || stats.FlushSizeMax != 5 || stats.FlushSizeSum != 9 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	if avg := stats.AverageFlushSize(); avg != 3 {
+		t.Errorf("Average flush size is %v", avg)
+	}
+}
+
+func TestUDPFlushSizeStats(t *testing.T) {
+	pc, gr := newUDPTestServer(t)
+	gr.MaxMetricsPerDatagram = 2
+
+	if err := gr.SendMetrics(testMetrics(5)); err != nil {
+		t.Fatal(err)
+	}
+	readDatagrams(t, pc, 3)
+	stats := gr.Stats()
+	if stats.Flushes != 3 || stats.FlushSizeMin != 1 || stats.FlushSizeMax != 2 || stats.FlushSizeSum != 5 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+}
+
+func TestReportFlushCount(t *testing.T) {
+	var buf, tee bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	gr.clock = newFakeClock()
+	gr.ReportFlushCount = true
+	gr.Tee = &tee
+	gr.RetainRecent = 10
+
+	gr.SendMetrics(testMetrics(3))
+	gr.SendMetrics(nil)
+	gr.SendMetric(NewMetric("bar", "1", 1500000000))
+	expected := "app.foo 0 1500000000\napp.foo 1 1500000000\napp.foo 2 1500000000\n" +
+		"app.graphite.flush.count 3 1500000000\n" +
+		"app.bar 1 1500000000\n" +
+		"app.graphite.flush.count 1 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if tee.String() != expected {
+		t.Errorf("Copied %q to Tee, expected %q", tee.String(), expected)
+	}
+	if lines := gr.RecentLines(); len(lines) != 6 || lines[5] != "app.graphite.flush.count 1 1500000000" {
+		t.Errorf("Retained %q, expected the flush counts as well", lines)
+	}
+}
+
+func TestReportDropped(t *testing.T) {
+	var buf, tee bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "app")
+	gr.clock = newFakeClock()
+	gr.MaxLineLength = 25
+	gr.ReportDropped = true
+	gr.Tee = &tee
+	gr.RetainRecent = 10
+
+	long := NewMetric("a.very.long.metric.name", "1", 1500000000)
+	gr.SendMetrics([]Metric{long, NewMetric("foo", "1", 1500000000), long})
+	gr.SendMetric(NewMetric("foo", "2", 1500000000))
+	// a send with nothing left to write doesn't flush
+	gr.SendMetric(long)
+	gr.Flush()
+	expected := "app.foo 1 1500000000\n" +
+		"app.graphite.dropped 2 1500000000\n" +
+		"app.foo 2 1500000000\n" +
+		"app.graphite.dropped 1 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+	if tee.String() != expected {
+		t.Errorf("Copied %q to Tee, expected %q", tee.String(), expected)
+	}
+	if lines := gr.RecentLines(); len(lines) != 4 || lines[3] != "app.graphite.dropped 1 1500000000" {
+		t.Errorf("Retained %q, expected the drop counts as well", lines)
+	}
+	if dropped := gr.Stats().MetricsDropped; dropped != 3 {
+		t.Errorf("Dropped %d metrics, expected 3", dropped)
+	}
+}
+
+func TestReconnects(t *testing.T) {
+	srv := newTestServer(t)
+	gr := newTestGraphite(t, srv)
+
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	if reconnects := gr.Stats().Reconnects; reconnects != 0 {
+		t.Errorf("Counted %d reconnections after the first connection", reconnects)
+	}
+	gr.Reset()
+	gr.broken = true
+	gr.SendMetric(NewMetric("foo", "2", 1500000000))
+	if reconnects := gr.Stats().Reconnects; reconnects != 2 {
+		t.Errorf("Counted %d reconnections, expected 2", reconnects)
+	}
+}
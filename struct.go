@@ -0,0 +1,58 @@
+package graphite
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// SendStruct sends the exported numeric fields of the struct v, or of the
+// struct v points to, as gauges named prefix.field with the current
+// timestamp. The name of a field can be changed with a `graphite:"name"` tag,
+// and `graphite:"-"` skips the field. Non-numeric fields are skipped.
+func (graphite *Graphite) SendStruct(prefix string, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return fmt.Errorf("graphite: SendStruct needs a struct, got %T", v)
+	}
+
+	timestamp := graphite.timestampNow().Unix()
+	prefix = metricPrefix(prefix)
+	var metrics []Metric
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("graphite"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+
+		var formatted string
+		switch fieldValue := value.Field(i); fieldValue.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			formatted = strconv.FormatInt(fieldValue.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			formatted = strconv.FormatUint(fieldValue.Uint(), 10)
+		case reflect.Float32, reflect.Float64:
+			formatted = formatFloat(fieldValue.Float())
+		default:
+			continue
+		}
+		metrics = append(metrics, NewMetric(prefix+name, formatted, timestamp))
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	return graphite.sendMetrics(metrics)
+}
@@ -0,0 +1,38 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+)
+
+type poolStats struct {
+	Active   int     `graphite:"active"`
+	Idle     uint32  `graphite:"idle"`
+	HitRatio float64 `graphite:"hit_ratio"`
+	Waits    int64
+	Ignored  int `graphite:"-"`
+	Name     string
+	private  int
+}
+
+func TestSendStruct(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+	stats := poolStats{Active: 3, Idle: 7, HitRatio: 0.875, Waits: -1, Ignored: 1, Name: "db", private: 2}
+
+	if err := gr.SendStruct("db.pool", &stats); err != nil {
+		t.Error(err)
+	}
+	expected := "db.pool.active 3 1500000000\n" +
+		"db.pool.idle 7 1500000000\n" +
+		"db.pool.hit_ratio 0.875 1500000000\n" +
+		"db.pool.Waits -1 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+
+	if err := gr.SendStruct("db.pool", 42); err == nil {
+		t.Error("Sending a non-struct did not return an error")
+	}
+}
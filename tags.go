@@ -0,0 +1,44 @@
+package graphite
+
+import (
+	"os"
+)
+
+// WithInstanceTag adds to DefaultTags a tag called tagKey with the value of
+// the environment variable envVar, e.g. HOSTNAME or INSTANCE_ID, read once
+// when it's called. Nothing is added when the variable is unset or empty. It
+// returns graphite, so that it can be chained after the constructor.
+func (graphite *Graphite) WithInstanceTag(tagKey, envVar string) *Graphite {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return graphite
+	}
+
+	graphite.mu.Lock()
+	defer graphite.mu.Unlock()
+
+	tags := make(map[string]string, len(graphite.DefaultTags)+1)
+	for key, tagValue := range graphite.DefaultTags {
+		tags[key] = tagValue
+	}
+	tags[tagKey] = value
+	graphite.DefaultTags = tags
+	return graphite
+}
+
+// addDefaultTags returns metric with the DefaultTags it doesn't have, the
+// caller must hold graphite.mu
+func (graphite *Graphite) addDefaultTags(metric Metric) Metric {
+	if len(graphite.DefaultTags) == 0 {
+		return metric
+	}
+	tags := make(map[string]string, len(graphite.DefaultTags)+len(metric.Tags))
+	for key, value := range graphite.DefaultTags {
+		tags[key] = value
+	}
+	for key, value := range metric.Tags {
+		tags[key] = value
+	}
+	metric.Tags = tags
+	return metric
+}
@@ -0,0 +1,34 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDefaultTags(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.DefaultTags = map[string]string{"dc": "eu", "env": "prod"}
+
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	gr.SendMetric(NewMetric("foo", "2", 1500000000).WithTag("env", "test"))
+	expected := "foo;dc=eu;env=prod 1 1500000000\n" +
+		"foo;dc=eu;env=test 2 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestWithInstanceTag(t *testing.T) {
+	t.Setenv("GRAPHITE_TEST_INSTANCE", "web-1")
+	t.Setenv("GRAPHITE_TEST_EMPTY", "")
+
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "").
+		WithInstanceTag("instance", "GRAPHITE_TEST_INSTANCE").
+		WithInstanceTag("pod", "GRAPHITE_TEST_EMPTY")
+	gr.SendMetric(NewMetric("foo", "1", 1500000000))
+	if expected := "foo;instance=web-1 1 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,176 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultDatagramSize keeps packed UDP datagrams within a 1500 bytes Ethernet
+// MTU, minus the IPv6 and UDP headers
+const defaultDatagramSize = 1432
+
+// udpRetries is the number of times a datagram is sent again when the write
+// fails with ENOBUFS, waiting udpRetryDelay before the first retry and doubling
+// the wait each time
+const (
+	udpRetries    = 3
+	udpRetryDelay = time.Millisecond
+)
+
+// datagramPacker packs carbon lines into UDP datagrams, sending a datagram
+// when adding a line would make it exceed maxSize bytes or maxMetrics lines
+type datagramPacker struct {
+	conn       net.Conn
+	stats      *Stats
+	maxSize    int
+	maxMetrics int
+	buf        []byte
+	metrics    int
+	// redial, when set, replaces conn after a refused write
+	redial func() (net.Conn, error)
+	// oversized collects the lines longer than maxSize when fallback is set
+	fallback  bool
+	oversized []string
+	// sent is the number of metrics in the datagrams sent successfully
+	sent int
+	// retain, when set, is called with each line of the datagrams sent
+	// successfully, and lines collects the lines of the current datagram
+	retain func(line string)
+	lines  []string
+}
+
+// newDatagramPacker returns a packer configured from MaxDatagramSize and
+// MaxMetricsPerDatagram; when both are zero each line is sent as its own
+// datagram
+func (graphite *Graphite) newDatagramPacker(ctx context.Context) *datagramPacker {
+	packer := &datagramPacker{
+		conn:       graphite.conn,
+		stats:      &graphite.stats,
+		maxSize:    graphite.MaxDatagramSize,
+		maxMetrics: graphite.MaxMetricsPerDatagram,
+		fallback:   graphite.TCPFallback,
+	}
+	if packer.maxSize == 0 && packer.maxMetrics == 0 {
+		packer.maxMetrics = 1
+	}
+	if packer.maxSize == 0 {
+		packer.maxSize = defaultDatagramSize
+	}
+	if graphite.RetainRecent > 0 || graphite.recent != nil {
+		packer.retain = graphite.retainRecent
+	}
+	if graphite.AutoReconnect {
+		packer.redial = func() (net.Conn, error) {
+			if err := graphite.connect(ctx); err != nil {
+				return nil, err
+			}
+			return graphite.conn, nil
+		}
+	}
+	return packer
+}
+
+// add appends line to the current datagram, sending it first if it's full. A
+// line longer than maxSize is sent in a datagram of its own.
+func (packer *datagramPacker) add(line string) error {
+	var err error
+	framed := frameLine(line)
+	if packer.fallback && len(framed) > packer.maxSize {
+		packer.oversized = append(packer.oversized, line)
+		return nil
+	}
+	if packer.metrics > 0 &&
+		(len(packer.buf)+len(framed) > packer.maxSize ||
+			(packer.maxMetrics > 0 && packer.metrics >= packer.maxMetrics)) {
+		err = packer.flush()
+	}
+	packer.buf = append(packer.buf, framed...)
+	packer.metrics++
+	if packer.retain != nil {
+		packer.lines = append(packer.lines, line)
+	}
+	return err
+}
+
+// flush sends the current datagram, if any. A datagram that was only
+// partially written is reported as an io.ErrShortWrite error.
+func (packer *datagramPacker) flush() error {
+	if packer.metrics == 0 {
+		return nil
+	}
+	n, err := packer.conn.Write(packer.buf)
+	delay := udpRetryDelay
+	for attempt := 0; isNoBufs(err) && attempt < udpRetries; attempt++ {
+		// the kernel queue is full during a burst, give it time to drain
+		packer.stats.UDPRetries++
+		time.Sleep(delay)
+		delay *= 2
+		n, err = packer.conn.Write(packer.buf)
+	}
+	if isConnRefused(err) && packer.redial != nil {
+		// an ICMP port unreachable for an earlier datagram, the relay
+		// may have restarted, possibly at a new address
+		packer.stats.UDPReconnects++
+		var conn net.Conn
+		if conn, err = packer.redial(); err == nil {
+			packer.conn = conn
+			n, err = conn.Write(packer.buf)
+		}
+	}
+	if err == nil && n < len(packer.buf) {
+		err = fmt.Errorf("graphite: sent %d of %d bytes of a datagram: %w", n, len(packer.buf), io.ErrShortWrite)
+	}
+	if err == nil {
+		packer.stats.recordFlush(packer.metrics)
+		packer.sent += packer.metrics
+		packer.retainLines(packer.lines)
+	}
+	packer.buf = packer.buf[:0]
+	packer.lines = packer.lines[:0]
+	packer.metrics = 0
+	return err
+}
+
+// retainLines passes lines, which were sent successfully, to retain
+func (packer *datagramPacker) retainLines(lines []string) {
+	if packer.retain == nil {
+		return
+	}
+	for _, line := range lines {
+		packer.retain(line)
+	}
+}
+
+// sendOversized sends lines too long for a datagram over a short-lived TCP
+// connection to the same host and port, giving up when ctx is done
+func (graphite *Graphite) sendOversized(ctx context.Context, lines []string) error {
+	address := net.JoinHostPort(graphite.Host, strconv.Itoa(graphite.Port))
+	graphite.debugf("Graphite: sending %d oversized metrics to tcp://%s", len(lines), address)
+	conn, err := graphite.dialer()(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	deadline := graphite.now().Add(graphite.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetWriteDeadline(deadline)
+
+	w := bufio.NewWriter(conn)
+	for _, line := range lines {
+		w.WriteString(frameLine(line))
+	}
+	err = w.Flush()
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		graphite.stats.recordFlush(len(lines))
+	}
+	return err
+}
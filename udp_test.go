@@ -0,0 +1,286 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newUDPTestServer listens on a loopback UDP port and returns it with the
+// client connected to it
+func newUDPTestServer(t *testing.T) (net.PacketConn, *Graphite) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	gr, err := GraphiteFactory(UDP, "127.0.0.1", pc.LocalAddr().(*net.UDPAddr).Port, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gr.Disconnect() })
+	return pc, gr
+}
+
+// readDatagrams reads n datagrams from pc
+func readDatagrams(t *testing.T, pc net.PacketConn, n int) []string {
+	var datagrams []string
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < n; i++ {
+		size, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datagrams = append(datagrams, string(buf[:size]))
+	}
+	return datagrams
+}
+
+func testMetrics(n int) []Metric {
+	metrics := make([]Metric, n)
+	for i := range metrics {
+		metrics[i] = NewMetric("foo", i, 1500000000)
+	}
+	return metrics
+}
+
+func TestUDPDatagramPerMetric(t *testing.T) {
+	pc, gr := newUDPTestServer(t)
+
+	if err := gr.SendMetrics(testMetrics(2)); err != nil {
+		t.Fatal(err)
+	}
+	datagrams := readDatagrams(t, pc, 2)
+	if datagrams[0] != "foo 0 1500000000\n" || datagrams[1] != "foo 1 1500000000\n" {
+		t.Errorf("Unexpected datagrams %q", datagrams)
+	}
+}
+
+func TestMaxMetricsPerDatagram(t *testing.T) {
+	pc, gr := newUDPTestServer(t)
+	gr.MaxMetricsPerDatagram = 2
+
+	if err := gr.SendMetrics(testMetrics(5)); err != nil {
+		t.Fatal(err)
+	}
+	datagrams := readDatagrams(t, pc, 3)
+	expected := []string{
+		"foo 0 1500000000\nfoo 1 1500000000\n",
+		"foo 2 1500000000\nfoo 3 1500000000\n",
+		"foo 4 1500000000\n",
+	}
+	for i := range expected {
+		if datagrams[i] != expected[i] {
+			t.Errorf("Datagram %d is %q, expected %q", i, datagrams[i], expected[i])
+		}
+	}
+}
+
+func TestMaxDatagramSize(t *testing.T) {
+	pc, gr := newUDPTestServer(t)
+	gr.MaxDatagramSize = 40
+	gr.MaxMetricsPerDatagram = 10
+
+	// each line is 17 bytes, so the byte limit hits before the count one
+	if err := gr.SendMetrics(testMetrics(3)); err != nil {
+		t.Fatal(err)
+	}
+	datagrams := readDatagrams(t, pc, 2)
+	if datagrams[0] != "foo 0 1500000000\nfoo 1 1500000000\n" || datagrams[1] != "foo 2 1500000000\n" {
+		t.Errorf("Unexpected datagrams %q", datagrams)
+	}
+}
+
+func TestUDPSocketBuffers(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	gr, err := NewGraphiteFromConfig(Config{
+		Host:             "127.0.0.1",
+		Port:             pc.LocalAddr().(*net.UDPAddr).Port,
+		Protocol:         UDP,
+		UDPSendBuffer:    1 << 20,
+		UDPReceiveBuffer: 1 << 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+	if gr.UDPSendBuffer != 1<<20 || gr.UDPReceiveBuffer != 1<<16 {
+		t.Errorf("Wrong buffer sizes %d and %d", gr.UDPSendBuffer, gr.UDPReceiveBuffer)
+	}
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Fatal(err)
+	}
+	if datagrams := readDatagrams(t, pc, 1); datagrams[0] != "foo 1 1500000000\n" {
+		t.Errorf("Unexpected datagram %q", datagrams[0])
+	}
+}
+
+// shortWriteConn is a net.Conn whose writes stop one byte short
+type shortWriteConn struct {
+	net.Conn
+	writes []string
+}
+
+func (conn *shortWriteConn) Write(p []byte) (int, error) {
+	conn.writes = append(conn.writes, string(p))
+	return len(p) - 1, nil
+}
+
+func TestUDPShortWrite(t *testing.T) {
+	conn := &shortWriteConn{}
+	gr := &Graphite{Protocol: UDP, conn: conn}
+
+	sent, err := gr.SendMetricOK(NewMetric("foo", "1", 1500000000))
+	if sent || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("SendMetricOK returned (%v, %v)", sent, err)
+	}
+	if len(conn.writes) != 1 || conn.writes[0] != "foo 1 1500000000\n" {
+		t.Errorf("Unexpected writes %q", conn.writes)
+	}
+	if stats := gr.Stats(); stats.SendErrors != 1 || stats.Flushes != 0 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	if !errors.Is(gr.LastError(), io.ErrShortWrite) {
+		t.Errorf("LastError is %v", gr.LastError())
+	}
+}
+
+// refusedConn is a net.Conn whose writes fail like after an ICMP port
+// unreachable
+type refusedConn struct {
+	net.Conn
+}
+
+func (conn *refusedConn) Write(p []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.ECONNREFUSED)}
+}
+
+func (conn *refusedConn) Close() error {
+	return nil
+}
+
+func TestUDPAutoReconnect(t *testing.T) {
+	pc, gr := newUDPTestServer(t)
+	gr.conn.Close()
+	gr.conn = &refusedConn{}
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Expected a refused write, got %v", err)
+	}
+
+	gr.AutoReconnect = true
+	if err := gr.SendMetric(NewMetric("foo", "2", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if datagrams := readDatagrams(t, pc, 1); datagrams[0] != "foo 2 1500000000\n" {
+		t.Errorf("Unexpected datagram %q", datagrams[0])
+	}
+	if stats := gr.Stats(); stats.UDPReconnects != 1 || stats.SendErrors != 1 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+}
+
+func TestUDPTCPFallback(t *testing.T) {
+	srv := newTestServer(t)
+	pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.Port())))
+	if err != nil {
+		t.Skipf("Can't listen on UDP port %d: %v", srv.Port(), err)
+	}
+	defer pc.Close()
+	gr, err := GraphiteFactory(UDP, "127.0.0.1", srv.Port(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Disconnect()
+	gr.MaxDatagramSize = 100
+	gr.TCPFallback = true
+
+	long := NewMetric(strings.Repeat("x", 100), "1", 1500000000)
+	err = gr.SendMetrics([]Metric{
+		NewMetric("foo", "1", 1500000000),
+		long,
+		NewMetric("bar", "2", 1500000000),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if sent := gr.Stats().MetricsSent; sent != 3 {
+		t.Errorf("Sent %d metrics, expected 3", sent)
+	}
+	if datagrams := readDatagrams(t, pc, 1); datagrams[0] != "foo 1 1500000000\nbar 2 1500000000\n" {
+		t.Errorf("Unexpected datagram %q", datagrams[0])
+	}
+	srv.waitForData(t, strings.Repeat("x", 100)+" 1 1500000000\n")
+}
+
+func TestUDPTCPFallbackOpTimeout(t *testing.T) {
+	_, gr := newUDPTestServer(t)
+	gr.MaxDatagramSize = 100
+	gr.TCPFallback = true
+	gr.OpTimeout = 50 * time.Millisecond
+	// a relay that never completes the TCP handshake
+	gr.dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	err := gr.SendMetric(NewMetric(strings.Repeat("x", 100), "1", 1500000000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %v, expected context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Sending the oversized metric took %v, expected it to stop after OpTimeout", elapsed)
+	}
+}
+
+// noBufsConn is a net.Conn failing the next failures writes with ENOBUFS
+type noBufsConn struct {
+	net.Conn
+	failures int
+	writes   []string
+}
+
+func (conn *noBufsConn) Write(p []byte) (int, error) {
+	if conn.failures > 0 {
+		conn.failures--
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.ENOBUFS)}
+	}
+	conn.writes = append(conn.writes, string(p))
+	return len(p), nil
+}
+
+func TestUDPRetryNoBufs(t *testing.T) {
+	conn := &noBufsConn{failures: 1}
+	gr := &Graphite{Protocol: UDP, conn: conn}
+
+	if err := gr.SendMetric(NewMetric("foo", "1", 1500000000)); err != nil {
+		t.Error(err)
+	}
+	if len(conn.writes) != 1 || conn.writes[0] != "foo 1 1500000000\n" {
+		t.Errorf("Unexpected writes %q", conn.writes)
+	}
+
+	conn.failures = 10
+	if err := gr.SendMetric(NewMetric("foo", "2", 1500000000)); !errors.Is(err, syscall.ENOBUFS) {
+		t.Errorf("Expected ENOBUFS, got %v", err)
+	}
+	if stats := gr.Stats(); stats.UDPRetries != 4 || stats.SendErrors != 1 || stats.MetricsSent != 1 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !plan9
+// +build !plan9
+
+package graphite
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnRefused reports whether err is an ECONNREFUSED, which a UDP write
+// returns after an ICMP port unreachable for an earlier datagram
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isNoBufs reports whether err is an ENOBUFS, which a UDP write returns when
+// the kernel queue is full
+func isNoBufs(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS)
+}
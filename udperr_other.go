@@ -0,0 +1,14 @@
+//go:build plan9
+// +build plan9
+
+package graphite
+
+// isConnRefused can't recognize refused UDP writes on this OS
+func isConnRefused(err error) bool {
+	return false
+}
+
+// isNoBufs can't recognize full kernel queues on this OS
+func isNoBufs(err error) bool {
+	return false
+}
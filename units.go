@@ -0,0 +1,33 @@
+package graphite
+
+import (
+	"strings"
+	"time"
+)
+
+// SendTiming sends d, in milliseconds, as a metric called name with the
+// current timestamp. With UnitSuffix set the name gets a ".ms" suffix, e.g.
+// SendTiming("db.query", d) sends db.query.ms.
+func (graphite *Graphite) SendTiming(name string, d time.Duration) error {
+	value := float64(d) / float64(time.Millisecond)
+	return graphite.SendMetric(NewMetricFloat(graphite.withUnit(name, "ms"), value, graphite.timestampNow().Unix()))
+}
+
+// SendBytes sends n as a metric called name with the current timestamp. With
+// UnitSuffix set the name gets a ".bytes" suffix.
+func (graphite *Graphite) SendBytes(name string, n int64) error {
+	return graphite.SendMetric(NewMetricInt(graphite.withUnit(name, "bytes"), n, graphite.timestampNow().Unix()))
+}
+
+// withUnit appends unit to name when UnitSuffix is set, unless name already
+// ends with it
+func (graphite *Graphite) withUnit(name, unit string) string {
+	graphite.mu.Lock()
+	suffix := graphite.UnitSuffix
+	graphite.mu.Unlock()
+
+	if !suffix || strings.HasSuffix(name, "."+unit) {
+		return name
+	}
+	return name + "." + unit
+}
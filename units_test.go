@@ -0,0 +1,37 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSendTiming(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+
+	gr.SendTiming("db.query", 1500*time.Microsecond)
+	gr.UnitSuffix = true
+	gr.SendTiming("db.query", 20*time.Millisecond)
+	gr.SendTiming("db.query.ms", 20*time.Millisecond)
+
+	expected := "db.query 1.5 1500000000\n" +
+		"db.query.ms 20 1500000000\n" +
+		"db.query.ms 20 1500000000\n"
+	if buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSendBytes(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGraphiteWriter(&buf, "")
+	gr.clock = newFakeClock()
+	gr.UnitSuffix = true
+
+	gr.SendBytes("response.size", 512)
+	if expected := "response.size.bytes 512 1500000000\n"; buf.String() != expected {
+		t.Errorf("Wrote %q, expected %q", buf.String(), expected)
+	}
+}